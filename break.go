@@ -0,0 +1,27 @@
+package sshproxy
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const breakRequestType = "break"
+
+// breakRequest is the payload of a "break" channel request,
+// as described in RFC 4335, section 3.
+type breakRequest struct {
+	Length uint32
+}
+
+// breakRequest calls OnBreak with the length of the "break" request with the
+// given payload. Malformed payloads are ignored, and relayed as is.
+func (h *Hooks) breakRequest(ctx context.Context, payload []byte) {
+	if h == nil || h.OnBreak == nil {
+		return
+	}
+	var req breakRequest
+	if err := ssh.Unmarshal(payload, &req); err == nil {
+		h.OnBreak(ctx, req.Length)
+	}
+}
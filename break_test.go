@@ -0,0 +1,59 @@
+package sshproxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_breakRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// like a serial console, the backend only accepts breaks of nonzero length
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			defer ch.Close()
+			go func() {
+				for req := range reqs {
+					var msg breakRequest
+					ok := req.Type == breakRequestType && ssh.Unmarshal(req.Payload, &msg) == nil && msg.Length > 0
+					_ = req.Reply(ok, nil)
+				}
+			}()
+		}
+	})
+	var lastLength uint32
+	proxy := New(backendAddr, testClientConfig())
+	proxy.Hooks = &Hooks{
+		OnBreak: func(_ context.Context, lengthMs uint32) { atomic.StoreUint32(&lastLength, lengthMs) },
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("open session channel: %v", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for _, length := range []uint32{500, 0} {
+		ok, err := ch.SendRequest(breakRequestType, true, ssh.Marshal(breakRequest{Length: length}))
+		if err != nil {
+			t.Fatalf("send break: %v", err)
+		}
+		if expected := length > 0; ok != expected {
+			t.Fatalf("expected reply %v to break of %dms, got %v", expected, length, ok)
+		}
+		if got := atomic.LoadUint32(&lastLength); got != length {
+			t.Fatalf("expected OnBreak with %dms, got %dms", length, got)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package sshproxy
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultBufferSize is the size of the buffers used to copy channel data
+// when ReverseProxy.BufferSize is zero, matching io.Copy.
+const defaultBufferSize = 32 * 1024
+
+// BufferPool is an interface for getting and returning temporary
+// byte slices for use by io.CopyBuffer.
+type BufferPool interface {
+	Get() []byte
+	Put([]byte)
+}
+
+// defaultBufferPools holds a shared *syncBufferPool for each buffer size.
+var defaultBufferPools sync.Map
+
+// syncBufferPool is a BufferPool of fixed size buffers backed by a sync.Pool.
+type syncBufferPool struct {
+	pool sync.Pool
+}
+
+func newSyncBufferPool(size int) *syncBufferPool {
+	return &syncBufferPool{pool: sync.Pool{
+		New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}}
+}
+
+func (p *syncBufferPool) Get() []byte { return *p.get() }
+
+func (p *syncBufferPool) Put(buf []byte) { p.put(&buf) }
+
+// get and put exchange the pointers held by the pool, such that returning
+// a buffer taken with get does not allocate a new slice header.
+func (p *syncBufferPool) get() *[]byte { return p.pool.Get().(*[]byte) }
+
+func (p *syncBufferPool) put(buf *[]byte) { p.pool.Put(buf) }
+
+// bufferPool returns the configured BufferPool, or a shared pool
+// of buffers of the configured size.
+func (r *ReverseProxy) bufferPool() BufferPool {
+	if r.BufferPool != nil {
+		return r.BufferPool
+	}
+	size := r.BufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	pool, ok := defaultBufferPools.Load(size)
+	if !ok {
+		pool, _ = defaultBufferPools.LoadOrStore(size, newSyncBufferPool(size))
+	}
+	return pool.(BufferPool)
+}
+
+// copyBuffer is like io.Copy, but uses a buffer from the pool,
+// which is returned once the copy has completed.
+func copyBuffer(dst io.Writer, src io.Reader, pool BufferPool) (int64, error) {
+	if p, ok := pool.(*syncBufferPool); ok {
+		buf := p.get()
+		defer p.put(buf)
+		return io.CopyBuffer(dst, src, *buf)
+	}
+	buf := pool.Get()
+	defer pool.Put(buf)
+	return io.CopyBuffer(dst, src, buf)
+}
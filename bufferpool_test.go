@@ -0,0 +1,91 @@
+package sshproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+// countingBufferPool counts the buffers taken from and returned to the pool.
+type countingBufferPool struct {
+	gets, puts int64
+}
+
+func (p *countingBufferPool) Get() []byte {
+	atomic.AddInt64(&p.gets, 1)
+	return make([]byte, 1024)
+}
+
+func (p *countingBufferPool) Put([]byte) { atomic.AddInt64(&p.puts, 1) }
+
+func Test_bufferPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool := &countingBufferPool{}
+	closed := make(chan struct{})
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.BufferPool = pool
+	proxy.Hooks = &Hooks{
+		OnChannelClose: func(context.Context, string, int64, int64) { close(closed) },
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testStdin(t, client)
+	<-closed
+
+	// a primary and stderr buffer for each direction
+	gets, puts := atomic.LoadInt64(&pool.gets), atomic.LoadInt64(&pool.puts)
+	if gets != 4 || puts != 4 {
+		t.Fatalf("expected 4 buffers taken and returned, got %d and %d", gets, puts)
+	}
+}
+
+func Test_syncBufferPoolPut(t *testing.T) {
+	pool := newSyncBufferPool(1024)
+	buf := pool.get()
+	if allocs := testing.AllocsPerRun(100, func() { pool.put(buf) }); allocs != 0 {
+		t.Fatalf("expected returning a buffer not to allocate, got %v allocations", allocs)
+	}
+}
+
+// memChannel is an in-memory ssh.Channel for exercising copies without a connection.
+type memChannel struct {
+	io.Reader
+	io.Writer
+	stderr io.ReadWriter
+}
+
+func (memChannel) Close() error      { return nil }
+func (memChannel) CloseWrite() error { return nil }
+
+func (memChannel) SendRequest(string, bool, []byte) (bool, error) { return false, nil }
+
+func (c memChannel) Stderr() io.ReadWriter { return c.stderr }
+
+// allocBufferPool allocates a new buffer for every copy, like io.Copy.
+type allocBufferPool struct{}
+
+func (allocBufferPool) Get() []byte { return make([]byte, defaultBufferSize) }
+func (allocBufferPool) Put([]byte)  {}
+
+func BenchmarkCopyChannels(b *testing.B) {
+	data := bytes.Repeat([]byte("a"), 64*1024)
+	for name, pool := range map[string]BufferPool{
+		"pooled":   nil,
+		"unpooled": allocBufferPool{},
+	} {
+		b.Run(name, func(b *testing.B) {
+			c := &proxyConn{proxy: &ReverseProxy{BufferPool: pool}, logger: printfLogger{}}
+			w := memChannel{Writer: io.Discard, stderr: &bytes.Buffer{}}
+			var total int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r := memChannel{Reader: bytes.NewReader(data), stderr: &bytes.Buffer{}}
+				c.copyChannels(w, r, &total, new(int64))
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Critical options of SSH user certificates, as described in
+// OpenSSH's PROTOCOL.certkeys file.
+const (
+	forceCommandOption  = "force-command"
+	sourceAddressOption = "source-address"
+)
+
+// criticalOption returns the value of the named critical option
+// with which the client authenticated.
+func (c *proxyConn) criticalOption(name string) (string, bool) {
+	if c.client == nil || c.client.Permissions == nil {
+		return "", false
+	}
+	value, ok := c.client.Permissions.CriticalOptions[name]
+	return value, ok
+}
+
+// checkSourceAddress returns an error unless the client's address is allowed
+// by the "source-address" critical option, if any.
+func (c *proxyConn) checkSourceAddress() error {
+	sourceAddrs, ok := c.criticalOption(sourceAddressOption)
+	if !ok {
+		return nil
+	}
+	tcpAddr, ok := c.client.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("%s: client address %v is not a TCP address", sourceAddressOption, c.client.RemoteAddr())
+	}
+	for _, sourceAddr := range strings.Split(sourceAddrs, ",") {
+		if ip := net.ParseIP(sourceAddr); ip != nil {
+			if ip.Equal(tcpAddr.IP) {
+				return nil
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(sourceAddr)
+		if err != nil {
+			return fmt.Errorf("%s: parse %q: %w", sourceAddressOption, sourceAddr, err)
+		}
+		if ipNet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: client address %v not allowed", sourceAddressOption, tcpAddr.IP)
+}
+
+// forceCommandRewrite returns a requestRewrite that replaces "exec", "shell",
+// and "subsystem" requests with an "exec" request of the "force-command"
+// critical option, if any and EnforceCertOptions is set.
+func (c *proxyConn) forceCommandRewrite() requestRewrite {
+	if !c.proxy.EnforceCertOptions {
+		return nil
+	}
+	cmd, ok := c.criticalOption(forceCommandOption)
+	if !ok {
+		return nil
+	}
+	return func(_ context.Context, req *ssh.Request) error {
+		switch req.Type {
+		case execRequestType, shellRequestType, subsystemRequestType:
+			req.Type = execRequestType
+			req.Payload = ssh.Marshal(execRequest{Command: cmd})
+		}
+		return nil
+	}
+}
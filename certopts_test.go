@@ -0,0 +1,133 @@
+package sshproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certServe returns a serve function that authenticates the client as if
+// with a user certificate carrying the given critical options.
+func certServe(t *testing.T, ctx context.Context, proxy *ReverseProxy, options map[string]string) func(*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request) error {
+	authority, err := generateSigner()
+	if err != nil {
+		t.Fatalf("generate signer: %v", err)
+	}
+	userKey, err := generateSigner()
+	if err != nil {
+		t.Fatalf("generate signer: %v", err)
+	}
+	cert := &ssh.Certificate{
+		Key:             userKey.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"test"},
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions:     ssh.Permissions{CriticalOptions: options},
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatalf("sign user certificate: %v", err)
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority:          func(ssh.PublicKey) bool { return true },
+		SupportedCriticalOptions: []string{forceCommandOption, sourceAddressOption},
+	}
+	return func(serverConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) error {
+		// as returned by a public key callback using the checker
+		if err := checker.CheckCert(serverConn.User(), cert); err != nil {
+			return err
+		}
+		serverConn.Permissions = &cert.Permissions
+		return proxy.Serve(ctx, serverConn, chans, reqs)
+	}
+}
+
+func Test_enforceForceCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.EnforceCertOptions = true
+	client, _ := newServedClient(t, certServe(t, ctx, proxy, map[string]string{forceCommandOption: "echo forced"}))
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	output, err := session.Output("echo original")
+	if err != nil {
+		t.Fatalf("run command: %v", err)
+	}
+	if string(output) != "forced\n" {
+		t.Fatalf("expected forced command output, got %q", output)
+	}
+
+	// shells run the forced command
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	var stdout lockedBuffer
+	session.Stdout = &stdout
+	if err := session.Shell(); err != nil {
+		t.Fatalf("start shell: %v", err)
+	}
+	if err := session.Wait(); err != nil {
+		t.Fatalf("wait for shell: %v", err)
+	}
+	if stdout.String() != "forced\n" {
+		t.Fatalf("expected forced command output, got %q", stdout.String())
+	}
+}
+
+func Test_enforceForceCommandRewrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.EnforceCertOptions = true
+	proxy.CommandRewrite = func(_ context.Context, cmd string) (string, error) {
+		return "echo rewritten", nil
+	}
+	client, _ := newServedClient(t, certServe(t, ctx, proxy, map[string]string{forceCommandOption: "echo forced"}))
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	output, err := session.Output("echo original")
+	if err != nil {
+		t.Fatalf("run command: %v", err)
+	}
+	if string(output) != "forced\n" {
+		t.Fatalf("expected forced command to take precedence over the rewrite, got %q", output)
+	}
+}
+
+func Test_enforceSourceAddress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, serveSessions)
+	for sourceAddrs, allowed := range map[string]bool{
+		"10.0.0.0/8":            false,
+		"10.0.0.0/8,127.0.0.1":  true,
+		"192.0.2.1,127.0.0.0/8": true,
+	} {
+		proxy := New(backendAddr, testClientConfig())
+		proxy.EnforceCertOptions = true
+		client, serveErr := newServedClient(t, certServe(t, ctx, proxy, map[string]string{sourceAddressOption: sourceAddrs}))
+		if allowed {
+			testSessionExec(t, client)
+			continue
+		}
+		if err := <-serveErr; err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Fatalf("expected client to be rejected by %s %q, got: %v", sourceAddressOption, sourceAddrs, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package sshproxy
+
+import "time"
+
+// clock abstracts the passage of time, such that tests may drive the
+// timeouts of a ReverseProxy deterministically with a fake clock.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+	NewTicker(d time.Duration) clockTicker
+	// AfterFunc calls f in its own goroutine once d has elapsed, unless the
+	// returned timer is stopped first. The timer's channel is unused.
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is the subset of *time.Timer used by the proxy.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// clockTicker is the subset of *time.Ticker used by the proxy.
+type clockTicker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) clockTimer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) NewTicker(d time.Duration) clockTicker { return realTicker{time.NewTicker(d)} }
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// clock returns the clock used for the proxy's timeouts,
+// which is substituted by tests.
+func (r *ReverseProxy) clock() clock {
+	if r.testClock != nil {
+		return r.testClock
+	}
+	return realClock{}
+}
@@ -0,0 +1,160 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only advances when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer { return c.newTimer(d, 0) }
+
+func (c *fakeClock) NewTicker(d time.Duration) clockTicker { return fakeTicker{c.newTimer(d, d)} }
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	t := c.newTimer(d, 0)
+	t.f = f
+	return t
+}
+
+func (c *fakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), when: c.now.Add(d), period: period, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the time forward by d, firing any timers that expire.
+// Like those of the time package, tickers drop ticks for slow receivers.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if !t.active || t.when.After(c.now) {
+			continue
+		}
+		if t.f != nil {
+			go t.f()
+		} else {
+			select {
+			case t.c <- c.now:
+			default:
+			}
+		}
+		if t.period > 0 {
+			for !t.when.After(c.now) {
+				t.when = t.when.Add(t.period)
+			}
+		} else {
+			t.active = false
+		}
+	}
+}
+
+// waitForTimers blocks until at least n timers or tickers are active.
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		c.mu.Lock()
+		active := 0
+		for _, timer := range c.timers {
+			if timer.active {
+				active++
+			}
+		}
+		c.mu.Unlock()
+		if active >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d active timers, got %d", n, active)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+	active bool
+	// f is called instead of sending on c if set by AfterFunc
+	f func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.when, t.active = t.clock.now.Add(d), true
+	return active
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
+
+func Test_idleTimeoutFakeClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := newFakeClock()
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.IdleTimeout = time.Minute
+	proxy.testClock = clk
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+
+	// activity resets the idle timer
+	clk.waitForTimers(t, 1)
+	clk.Advance(30 * time.Second)
+	testSessionExec(t, client)
+	clk.Advance(30 * time.Second)
+	select {
+	case err := <-serveErr:
+		t.Fatalf("expected connection to remain open after activity, got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(time.Minute)
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Fatalf("expected ErrIdleTimeout, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after the idle timeout")
+	}
+}
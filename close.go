@@ -0,0 +1,78 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	closedByClient int32 = iota + 1
+	closedByTarget
+)
+
+// markClosed records that the client or target connection has closed,
+// unless the other side was recorded as having closed first.
+func (c *proxyConn) markClosed(client bool) {
+	side := closedByTarget
+	if client {
+		side = closedByClient
+	}
+	atomic.CompareAndSwapInt32(&c.closedBy, 0, side)
+}
+
+// closeError classifies err, as returned by waiting on either connection,
+// as one of ErrProtocol, ErrTargetClosed, or ErrClientClosed. Protocol
+// errors are logged.
+func (c *proxyConn) closeError(err error) error {
+	reason := ErrClientClosed
+	if atomic.LoadInt32(&c.closedBy) == closedByTarget {
+		reason = ErrTargetClosed
+	}
+	if isProtocolError(err) {
+		reason = ErrProtocol
+	}
+	closeErr := &closeError{reason: reason, err: err}
+	if reason == ErrProtocol {
+		c.logger.Warn("sshproxy: ReverseProxy %v", closeErr)
+		c.logEvent(Event{Type: EventError, Err: closeErr})
+	}
+	return closeErr
+}
+
+// closeError wraps the error that terminated a connection, matching the
+// sentinel reason with errors.Is in addition to the wrapped error.
+type closeError struct {
+	reason error
+	err    error
+}
+
+func (e *closeError) Error() string {
+	if e.err == nil {
+		return e.reason.Error()
+	}
+	return e.reason.Error() + ": " + e.err.Error()
+}
+
+func (e *closeError) Unwrap() error { return e.err }
+
+func (e *closeError) Is(target error) bool { return target == e.reason }
+
+// isProtocolError reports whether err, as returned by ssh.Conn.Wait, was
+// caused by an SSH protocol error rather than a disconnect, closure, or
+// network error.
+func isProtocolError(err error) bool {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return false
+	}
+	// disconnect messages sent by the peer are not exported by the ssh package
+	return !strings.HasPrefix(err.Error(), "ssh: disconnect")
+}
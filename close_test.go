@@ -0,0 +1,158 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_closeErrorClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+	client.Close()
+
+	err := <-serveErr
+	if !errors.Is(err, ErrClientClosed) || errors.Is(err, ErrTargetClosed) || errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected ErrClientClosed, got: %v", err)
+	}
+}
+
+func Test_closeErrorTarget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for newCh := range chans {
+				_ = newCh.Reject(ssh.Prohibited, "")
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+	})
+	proxy := New(backendAddr, testClientConfig())
+	_, serveErr := newProxiedClient(t, ctx, proxy)
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrTargetClosed) || errors.Is(err, ErrClientClosed) || errors.Is(err, ErrProtocol) {
+			t.Fatalf("expected ErrTargetClosed, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after the target closed")
+	}
+}
+
+func Test_closeErrorProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	left, right, err := tcpPipeWithDialer(net.Dial, net.Listen)
+	if err != nil {
+		t.Fatalf("new net pipe: %v", err)
+	}
+	defer left.Close()
+	defer right.Close()
+
+	signer, err := generateSigner()
+	if err != nil {
+		t.Fatalf("generate signer: %v", err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+	serveErr := make(chan error, 1)
+	go func() {
+		serverConn, chans, reqs, err := ssh.NewServerConn(right, serverConfig)
+		if err != nil {
+			serveErr <- err
+			return
+		}
+		proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+		proxy.ErrorLog = log.New(io.Discard, "", 0)
+		serveErr <- proxy.Serve(ctx, serverConn, chans, reqs)
+	}()
+
+	clientConn, _, _, err := ssh.NewClientConn(left, "localhost", testClientConfig())
+	if err != nil {
+		t.Fatalf("new client conn: %v", err)
+	}
+	defer clientConn.Close()
+	// write garbage bypassing the client's encryption
+	if _, err := left.Write(make([]byte, 1024)); err != nil {
+		t.Fatalf("write garbage: %v", err)
+	}
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrProtocol) {
+			t.Fatalf("expected ErrProtocol, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after a protocol error")
+	}
+}
+
+func Test_isProtocolError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		io.EOF:        false,
+		net.ErrClosed: false,
+		&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}: false,
+		errors.New("ssh: disconnect, reason 11: bye"):                         false,
+		errors.New("ssh: MAC failure"):                                        true,
+	} {
+		if isProtocolError(err) != expected {
+			t.Errorf("expected isProtocolError(%v) to be %v", err, expected)
+		}
+	}
+}
+
+func Test_targetCloseEndsClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		newCh := <-chans
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(chReqs)
+		defer ch.Close()
+		// the backend disappears once the session is in use
+		_, _ = ch.Read(make([]byte, 1))
+		_ = conn.Close()
+	})
+	proxy := New(backendAddr, testClientConfig())
+	client, _ := newProxiedClient(t, ctx, proxy)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("stdin pipe: %v", err)
+	}
+	if _, err := stdin.Write([]byte("a")); err != nil {
+		t.Fatalf("write stdin: %v", err)
+	}
+
+	clientDone := make(chan error, 1)
+	go func() { clientDone <- client.Wait() }()
+	select {
+	case <-clientDone:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected client connection to close after the target closed")
+	}
+}
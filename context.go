@@ -0,0 +1,41 @@
+package sshproxy
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// permissionsKey is the context key for the permissions of the client
+// connection being served.
+type permissionsKey struct{}
+
+// PermissionsFromContext returns the permissions with which the client
+// connection being served was authenticated, as returned by the
+// authentication callbacks of its ssh.ServerConfig. It is available to the
+// context passed by Serve to its callbacks, including Authorizer,
+// TargetResolver, Dial, DialClient, the filters and rewrites, and Hooks. The
+// second result reports whether the context carries permissions.
+func PermissionsFromContext(ctx context.Context) (*ssh.Permissions, bool) {
+	perms, ok := ctx.Value(permissionsKey{}).(*ssh.Permissions)
+	return perms, ok && perms != nil
+}
+
+// remoteForwardsKey is the context key for the remote port forwards of the
+// client connection being served.
+type remoteForwardsKey struct{}
+
+// RemoteForwardsFromContext returns the remote port forwards currently
+// granted by the target to the client connection being served, in the order
+// they were granted. Forwards are added when the target replies with success
+// to a "tcpip-forward" request that wants a reply, and removed when it does
+// so to the matching "cancel-tcpip-forward" request. It is available to the
+// same callbacks as PermissionsFromContext. The second result reports whether
+// the context belongs to a served connection.
+func RemoteForwardsFromContext(ctx context.Context) ([]RemoteForward, bool) {
+	forwards, ok := ctx.Value(remoteForwardsKey{}).(*remoteForwards)
+	if !ok {
+		return nil, false
+	}
+	return forwards.list(), true
+}
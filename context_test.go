@@ -0,0 +1,98 @@
+package sshproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_permissionsFromContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, ok := PermissionsFromContext(ctx); ok {
+		t.Fatalf("expected no permissions in background context")
+	}
+
+	// each callback records the tenant extension found in its context
+	var mu sync.Mutex
+	tenants := make(map[string]string)
+	record := func(ctx context.Context, callback string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if perms, ok := PermissionsFromContext(ctx); ok {
+			tenants[callback] = perms.Extensions["tenant"]
+		}
+	}
+
+	backendAddr := newTestBackend(t, serveSessions)
+	proxy := New("backend", testClientConfig())
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		record(ctx, "Dial")
+		var d net.Dialer
+		return d.DialContext(ctx, network, backendAddr)
+	}
+	proxy.ChannelFilter = func(ctx context.Context, channelType string, extraData []byte) bool {
+		record(ctx, "ChannelFilter")
+		return true
+	}
+	proxy.RequestFilter = func(ctx context.Context, reqType string, payload []byte) bool {
+		record(ctx, "RequestFilter")
+		return true
+	}
+	proxy.CommandRewrite = func(ctx context.Context, cmd string) (string, error) {
+		record(ctx, "CommandRewrite")
+		return cmd, nil
+	}
+	proxy.Hooks = &Hooks{
+		OnChannelOpen: func(ctx context.Context, channelType string, extraData []byte) {
+			record(ctx, "OnChannelOpen")
+		},
+	}
+
+	left, right, err := tcpPipeWithDialer(net.Dial, net.Listen)
+	if err != nil {
+		t.Fatalf("new net pipe: %v", err)
+	}
+	defer left.Close()
+	defer right.Close()
+
+	signer, err := generateSigner()
+	if err != nil {
+		t.Fatalf("generate signer: %v", err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: map[string]string{"tenant": "acme"}}, nil
+		},
+	}
+	serverConfig.AddHostKey(signer)
+	go func() {
+		serverConn, chans, reqs, err := ssh.NewServerConn(right, serverConfig)
+		if err != nil {
+			return
+		}
+		_ = proxy.Serve(ctx, serverConn, chans, reqs)
+	}()
+
+	clientConfig := testClientConfig()
+	clientConfig.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	clientConn, chans, reqs, err := ssh.NewClientConn(left, "localhost", clientConfig)
+	if err != nil {
+		t.Fatalf("new client conn: %v", err)
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	defer client.Close()
+	testSessionExec(t, client)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, callback := range []string{"Dial", "ChannelFilter", "RequestFilter", "CommandRewrite", "OnChannelOpen"} {
+		if tenants[callback] != "acme" {
+			t.Fatalf("expected permissions extension in %s context, got %q", callback, tenants[callback])
+		}
+	}
+}
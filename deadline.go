@@ -0,0 +1,90 @@
+package sshproxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadlineConn extends the read and write deadlines of a net.Conn by timeout
+// before each Read and Write, calling expired once if a deadline is exceeded.
+type deadlineConn struct {
+	net.Conn
+	clock   clock
+	timeout time.Duration
+	expired func()
+	once    *sync.Once
+}
+
+// newDeadlineConn wraps conn such that expired is called once a read or
+// write blocks for longer than timeout. Connections that do not support
+// deadlines, such as the channels returned by JumpDialer, fall back to a
+// timerConn, as does any clock other than the real clock, since deadlines
+// are enforced by the runtime in real time.
+func newDeadlineConn(clk clock, conn net.Conn, timeout time.Duration, expired func()) net.Conn {
+	if _, ok := clk.(realClock); !ok {
+		return newTimerConn(clk, conn, timeout, expired)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return newTimerConn(clk, conn, timeout, expired)
+	}
+	return deadlineConn{Conn: conn, clock: clk, timeout: timeout, expired: expired, once: new(sync.Once)}
+}
+
+func (c deadlineConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(c.clock.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(p)
+	c.check(err)
+	return n, err
+}
+
+func (c deadlineConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(c.clock.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(p)
+	c.check(err)
+	return n, err
+}
+
+func (c deadlineConn) check(err error) {
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		c.once.Do(c.expired)
+	}
+}
+
+// timerConn calls expired and closes the connection once no read has
+// returned for timeout. Unlike deadlineConn, it does not detect stalled
+// writes, which are left to WriteTimeout and KeepAlive.
+type timerConn struct {
+	net.Conn
+	timeout time.Duration
+	timer   clockTimer
+}
+
+func newTimerConn(clk clock, conn net.Conn, timeout time.Duration, expired func()) net.Conn {
+	var once sync.Once
+	c := &timerConn{Conn: conn, timeout: timeout}
+	c.timer = clk.AfterFunc(timeout, func() {
+		once.Do(expired)
+		_ = conn.Close()
+	})
+	return c
+}
+
+func (c *timerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err == nil {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *timerConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
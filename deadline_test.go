@@ -0,0 +1,95 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_connDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.ConnDeadline = 100 * time.Millisecond
+	_, serveErr := newProxiedClient(t, ctx, proxy)
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrConnDeadline) {
+			t.Fatalf("expected ErrConnDeadline, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after the connection deadline")
+	}
+}
+
+func Test_connDeadlineKeepAlive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.ConnDeadline = 200 * time.Millisecond
+	proxy.KeepAlive = 20 * time.Millisecond
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+
+	select {
+	case err := <-serveErr:
+		t.Fatalf("expected keepalives to hold the connection open, got: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	testSessionExec(t, client)
+}
+
+func Test_connDeadlineJumpDialer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// channels through a jump host do not support deadlines
+	jumpAddr := newTestBackend(t, serveSessions)
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.Dial = JumpDialer(jumpAddr, testClientConfig())
+	proxy.ConnDeadline = 200 * time.Millisecond
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrConnDeadline) {
+			t.Fatalf("expected ErrConnDeadline, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after the connection deadline")
+	}
+}
+
+func Test_connDeadlineFakeClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := newFakeClock()
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.ConnDeadline = time.Minute
+	proxy.testClock = clk
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+
+	clk.waitForTimers(t, 1)
+	clk.Advance(30 * time.Second)
+	select {
+	case err := <-serveErr:
+		t.Fatalf("expected connection to remain open before the deadline, got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(time.Minute)
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrConnDeadline) {
+			t.Fatalf("expected ErrConnDeadline, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after the connection deadline")
+	}
+}
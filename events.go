@@ -0,0 +1,75 @@
+package sshproxy
+
+import (
+	"time"
+)
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+const (
+	// EventConnOpen is emitted once the connection to the target is established.
+	EventConnOpen EventType = "conn_open"
+	// EventConnClose is emitted when Serve returns after EventConnOpen,
+	// with the connection's Stats, Duration, and terminating Err.
+	EventConnClose EventType = "conn_close"
+	// EventChannelOpen is emitted when either side opens a channel.
+	EventChannelOpen EventType = "channel_open"
+	// EventRequest is emitted for each global or channel request.
+	EventRequest EventType = "request"
+	// EventError is emitted for errors that occur while proxying.
+	EventError EventType = "error"
+	// EventWeakHostKey is emitted when the target presents a host key
+	// using a deprecated algorithm.
+	EventWeakHostKey EventType = "weak_host_key"
+)
+
+// Event is a structured record of an occurrence while proxying a connection.
+// Fields that do not apply to the event's Type are left as zero values.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// User and ClientAddr identify the client connection, if known.
+	User       string
+	ClientAddr string
+	// TargetAddr is the address of the proxy target, if resolved.
+	TargetAddr string
+
+	// ChannelType is set for EventChannelOpen.
+	ChannelType string
+	// RequestType and WantReply are set for EventRequest.
+	RequestType string
+	WantReply   bool
+	// HostKeyType is set for EventWeakHostKey.
+	HostKeyType string
+
+	// Stats and Duration are set for EventConnClose.
+	Stats    Stats
+	Duration time.Duration
+
+	// Err is set for EventError, and for EventConnClose
+	// if Serve returned an error.
+	Err error
+}
+
+// EventLogger receives structured events emitted while proxying.
+// LogEvent may be called concurrently.
+type EventLogger interface {
+	LogEvent(Event)
+}
+
+// logEvent fills in the connection's details and emits the event
+// to the configured EventLogger, if any.
+func (c *proxyConn) logEvent(e Event) {
+	if c.proxy.Events == nil {
+		return
+	}
+	e.Time = c.proxy.clock().Now()
+	if c.client != nil {
+		e.User = c.client.User()
+		e.ClientAddr = c.client.RemoteAddr().String()
+	}
+	e.TargetAddr = c.target
+	c.proxy.Events.LogEvent(e)
+}
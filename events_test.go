@@ -0,0 +1,77 @@
+package sshproxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (e *eventRecorder) LogEvent(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *eventRecorder) types() []EventType {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	types := make([]EventType, 0, len(e.events))
+	for _, event := range e.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func Test_events(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := &eventRecorder{}
+	backendAddr := newTestBackend(t, serveSessions)
+	proxy := New(backendAddr, testClientConfig())
+	proxy.Events = events
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testStdin(t, client)
+	client.Close()
+	<-serveErr
+
+	types := events.types()
+	expected := []EventType{EventConnOpen, EventChannelOpen, EventRequest, EventRequest, EventConnClose}
+	if len(types) != len(expected) {
+		t.Fatalf("unexpected events, expected %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("unexpected events, expected %v, got %v", expected, types)
+		}
+	}
+
+	closeEvent := events.events[len(events.events)-1]
+	if closeEvent.User != "test" || closeEvent.TargetAddr != backendAddr || closeEvent.ClientAddr == "" {
+		t.Fatalf("unexpected connection details: %+v", closeEvent)
+	}
+	if closeEvent.Stats != (Stats{BytesClientToTarget: 8, BytesTargetToClient: 8}) {
+		t.Fatalf("unexpected stats: %+v", closeEvent.Stats)
+	}
+	if closeEvent.Duration <= 0 {
+		t.Fatalf("expected positive duration, got %v", closeEvent.Duration)
+	}
+}
+
+func Test_eventsDialFailure(t *testing.T) {
+	events := &eventRecorder{}
+	proxy := New("/tmp/sshproxy-null.sock", testClientConfig())
+	proxy.Events = events
+	err := proxy.Serve(context.Background(), nil, nil, nil)
+	if err == nil {
+		t.Fatalf("expected error from reverse proxy, got: %v", err)
+	}
+	if len(events.events) != 1 || events.events[0].Type != EventError || events.events[0].Err.Error() != err.Error() {
+		t.Fatalf("expected single error event, got: %+v", events.events)
+	}
+}
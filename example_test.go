@@ -0,0 +1,76 @@
+package sshproxy_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cmoog/sshproxy"
+)
+
+// This example routes each client to a target chosen by the user name it
+// authenticates with, in the form "user@backend". The authentication
+// callback validates the name and passes the parsed target to the resolver
+// through the connection's permissions.
+func ExampleReverseProxy_targetResolver() {
+	const targetExtension = "target-host"
+	backends := map[string]string{
+		"db":  "10.0.0.10:22",
+		"web": "10.0.0.20:22",
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			_, backend, ok := strings.Cut(conn.User(), "@")
+			if !ok || backends[backend] == "" {
+				return nil, errors.New("unknown backend")
+			}
+			// a real server would also verify the password here
+			return &ssh.Permissions{
+				Extensions: map[string]string{targetExtension: backend},
+			}, nil
+		},
+	}
+
+	proxy := &sshproxy.ReverseProxy{
+		TargetResolver: func(ctx context.Context, serverConn *ssh.ServerConn) (string, *ssh.ClientConfig, error) {
+			user, _, _ := strings.Cut(serverConn.User(), "@")
+			backend := serverConn.Permissions.Extensions[targetExtension]
+			return backends[backend], &ssh.ClientConfig{
+				User:            user,
+				Auth:            []ssh.AuthMethod{ssh.Password("password")},
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				Timeout:         3 * time.Second,
+			}, nil
+		},
+	}
+
+	// host keys are added with serverConfig.AddHostKey
+
+	l, err := net.Listen("tcp", "localhost:2222")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			serverConn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if err := proxy.Serve(context.Background(), serverConn, chans, reqs); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,39 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const execRequestType = "exec"
+
+// execRequest is the payload of an "exec" channel request,
+// as described in RFC 4254, section 6.5.
+type execRequest struct {
+	Command string
+}
+
+// commandRewrite returns a requestRewrite that applies CommandRewrite
+// to "exec" requests.
+func (r *ReverseProxy) commandRewrite() requestRewrite {
+	if r.CommandRewrite == nil {
+		return nil
+	}
+	return func(ctx context.Context, req *ssh.Request) error {
+		if req.Type != execRequestType {
+			return nil
+		}
+		var exec execRequest
+		if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+			return fmt.Errorf("parse exec payload: %w", err)
+		}
+		cmd, err := r.CommandRewrite(ctx, exec.Command)
+		if err != nil {
+			return fmt.Errorf("rewrite command: %w", err)
+		}
+		req.Payload = ssh.Marshal(execRequest{Command: cmd})
+		return nil
+	}
+}
@@ -0,0 +1,59 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_commandRewrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.CommandRewrite = func(_ context.Context, cmd string) (string, error) {
+		if strings.Contains(cmd, "rm -rf") {
+			return "", errors.New("command not permitted")
+		}
+		return "echo wrapped; " + cmd, nil
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	// multi-byte characters change the encoded length of the command
+	output, err := session.Output("echo héllo 世界")
+	if err != nil {
+		t.Fatalf("run command: %v", err)
+	}
+	if string(output) != "wrapped\nhéllo 世界\n" {
+		t.Fatalf("unexpected output of rewritten command: %q", output)
+	}
+
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	if err := session.Run("rm -rf /tmp/nothing"); err == nil {
+		t.Fatalf("expected rejected command to fail")
+	}
+}
+
+func Test_commandRewriteMalformed(t *testing.T) {
+	proxy := &ReverseProxy{CommandRewrite: func(_ context.Context, cmd string) (string, error) { return cmd, nil }}
+	rewrite := proxy.commandRewrite()
+	if err := rewrite(context.Background(), &ssh.Request{Type: execRequestType, Payload: []byte("invalid")}); err == nil {
+		t.Fatalf("expected malformed exec payload to be rejected")
+	}
+	req := &ssh.Request{Type: execRequestType, Payload: ssh.Marshal(execRequest{Command: "true"})}
+	if err := rewrite(context.Background(), req); err != nil || string(req.Payload) != string(ssh.Marshal(execRequest{Command: "true"})) {
+		t.Fatalf("unexpected rewritten payload %q: %v", req.Payload, err)
+	}
+}
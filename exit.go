@@ -0,0 +1,88 @@
+package sshproxy
+
+import (
+	"context"
+	"golang.org/x/crypto/ssh"
+)
+
+// ExitInfo describes how a command run in a session exited, as reported by
+// the target with an "exit-status" or "exit-signal" channel request.
+type ExitInfo struct {
+	// Status is the exit status of the command. It is only meaningful
+	// if Signal is empty.
+	Status uint32
+
+	// Signal is the name of the signal that terminated the command,
+	// without the "SIG" prefix, such as "KILL". CoreDumped and ErrorMessage
+	// are only set along with Signal.
+	Signal       string
+	CoreDumped   bool
+	ErrorMessage string
+}
+
+const (
+	exitStatusRequestType = "exit-status"
+	exitSignalRequestType = "exit-signal"
+)
+
+// exitStatusMsg is the payload of an "exit-status" channel request,
+// as described in RFC 4254, section 6.10.
+type exitStatusMsg struct {
+	Status uint32
+}
+
+// exitSignalMsg is the payload of an "exit-signal" channel request,
+// as described in RFC 4254, section 6.10.
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// exitRewrite returns a requestRewrite that reports the exit of commands
+// on channels of the given type to OnExit, and applies ExitRewrite.
+func (r *ReverseProxy) exitRewrite(channelType string) requestRewrite {
+	if r.OnExit == nil && r.ExitRewrite == nil {
+		return nil
+	}
+	return func(ctx context.Context, req *ssh.Request) error {
+		switch req.Type {
+		case exitStatusRequestType:
+			var msg exitStatusMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				return nil
+			}
+			info := r.exit(ctx, channelType, ExitInfo{Status: msg.Status})
+			req.Payload = ssh.Marshal(exitStatusMsg{Status: info.Status})
+		case exitSignalRequestType:
+			var msg exitSignalMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				return nil
+			}
+			info := r.exit(ctx, channelType, ExitInfo{
+				Signal:       msg.Signal,
+				CoreDumped:   msg.CoreDumped,
+				ErrorMessage: msg.Error,
+			})
+			req.Payload = ssh.Marshal(exitSignalMsg{
+				Signal:     info.Signal,
+				CoreDumped: info.CoreDumped,
+				Error:      info.ErrorMessage,
+				Lang:       msg.Lang,
+			})
+		}
+		return nil
+	}
+}
+
+// exit reports info to OnExit and returns the result of ExitRewrite.
+func (r *ReverseProxy) exit(ctx context.Context, channelType string, info ExitInfo) ExitInfo {
+	if r.OnExit != nil {
+		r.OnExit(ctx, channelType, info)
+	}
+	if r.ExitRewrite != nil {
+		info = r.ExitRewrite(ctx, channelType, info)
+	}
+	return info
+}
@@ -0,0 +1,81 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_onExit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type exit struct {
+		channelType string
+		status      ExitInfo
+	}
+	exits := make(chan exit, 1)
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.OnExit = func(_ context.Context, channelType string, status ExitInfo) {
+		exits <- exit{channelType, status}
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testExitCode(t, client)
+
+	if e := <-exits; e != (exit{"session", ExitInfo{Status: 123}}) {
+		t.Fatalf("unexpected exit, got %+v", e)
+	}
+}
+
+func Test_exitRewrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.ExitRewrite = func(_ context.Context, channelType string, status ExitInfo) ExitInfo {
+		if status.Status == 123 {
+			status.Status = 7
+		}
+		return status
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+
+	var exitErr *ssh.ExitError
+	if err := session.Run("exit 123"); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 7 {
+		t.Fatalf("expected rewritten exit status 7, got: %v", err)
+	}
+}
+
+func Test_exitRewriteSignal(t *testing.T) {
+	proxy := &ReverseProxy{
+		ExitRewrite: func(_ context.Context, channelType string, status ExitInfo) ExitInfo {
+			status.Signal = "TERM"
+			status.Status = 1
+			return status
+		},
+	}
+	rewrite := proxy.exitRewrite("session")
+	req := &ssh.Request{Type: exitSignalRequestType, Payload: ssh.Marshal(exitSignalMsg{Signal: "KILL", CoreDumped: true, Error: "killed"})}
+	if err := rewrite(context.Background(), req); err != nil {
+		t.Fatalf("rewrite exit-signal: %v", err)
+	}
+
+	var msg exitSignalMsg
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		t.Fatalf("parse exit-signal payload: %v", err)
+	}
+	if msg != (exitSignalMsg{Signal: "TERM", CoreDumped: true, Error: "killed"}) {
+		t.Fatalf("unexpected rewritten exit signal, got %+v", msg)
+	}
+	req = &ssh.Request{Type: "env", Payload: []byte("untouched")}
+	if err := rewrite(context.Background(), req); err != nil || string(req.Payload) != "untouched" {
+		t.Fatalf("expected other requests to be untouched")
+	}
+}
@@ -0,0 +1,184 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	directTCPIPChannelType  = "direct-tcpip"
+	tcpipForwardRequestType = "tcpip-forward"
+
+	directStreamLocalChannelType = "direct-streamlocal@openssh.com"
+
+	cancelTCPIPForwardRequestType = "cancel-tcpip-forward"
+)
+
+// directTCPIPMsg is the extra data of a "direct-tcpip" channel open,
+// as described in RFC 4254, section 7.2.
+type directTCPIPMsg struct {
+	DestHost   string
+	DestPort   uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// allowForward applies the ForwardFilter to the extra data of a
+// "direct-tcpip" channel, returning a rejection message if it is denied.
+// As the ForwardFilter cannot judge socket paths, forwarding to Unix sockets
+// with "direct-streamlocal@openssh.com" channels is always denied.
+func (c *proxyConn) allowForward(ctx context.Context, channelType string, extraData []byte) (string, bool) {
+	if channelType == directStreamLocalChannelType {
+		return "forwarding to unix sockets is not permitted", false
+	}
+	var msg directTCPIPMsg
+	if err := ssh.Unmarshal(extraData, &msg); err != nil {
+		return "malformed direct-tcpip request", false
+	}
+	if !c.proxy.ForwardFilter(ctx, msg.DestHost, msg.DestPort) {
+		dest := net.JoinHostPort(msg.DestHost, strconv.FormatUint(uint64(msg.DestPort), 10))
+		return fmt.Sprintf("forwarding to %s is not permitted", dest), false
+	}
+	return "", true
+}
+
+// isLocalForward reports whether channels of the given type are local
+// forwards, which are subject to the ForwardFilter.
+func isLocalForward(channelType string) bool {
+	return channelType == directTCPIPChannelType || channelType == directStreamLocalChannelType
+}
+
+// tcpipForwardMsg is the payload of a "tcpip-forward" global request,
+// as described in RFC 4254, section 7.1.
+type tcpipForwardMsg struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// tcpipForwardReply is the payload of the reply to a "tcpip-forward" request
+// for port 0, carrying the port allocated by the target.
+type tcpipForwardReply struct {
+	Port uint32
+}
+
+// RemoteForward is a remote port forward granted to a client by the target,
+// as requested with a "tcpip-forward" global request.
+type RemoteForward struct {
+	BindAddr string
+	// BindPort is the port allocated by the target if the client
+	// requested port 0.
+	BindPort uint32
+}
+
+// remoteForwards tracks the remote port forwards granted to a client
+// connection, in the order they were granted.
+type remoteForwards struct {
+	mu       sync.Mutex
+	forwards []RemoteForward
+}
+
+// list returns a copy of the granted forwards.
+func (f *remoteForwards) list() []RemoteForward {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]RemoteForward(nil), f.forwards...)
+}
+
+// update records the effect of a successful "tcpip-forward" or
+// "cancel-tcpip-forward" request, given its payload and the target's reply.
+// Malformed payloads are ignored.
+func (f *remoteForwards) update(reqType string, payload, reply []byte) {
+	var msg tcpipForwardMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return
+	}
+	forward := RemoteForward{BindAddr: msg.BindAddr, BindPort: msg.BindPort}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch reqType {
+	case tcpipForwardRequestType:
+		if forward.BindPort == 0 {
+			var allocated tcpipForwardReply
+			if err := ssh.Unmarshal(reply, &allocated); err == nil {
+				forward.BindPort = allocated.Port
+			}
+		}
+		f.forwards = append(f.forwards, forward)
+	case cancelTCPIPForwardRequestType:
+		for i, granted := range f.forwards {
+			if granted == forward {
+				f.forwards = append(f.forwards[:i], f.forwards[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// remoteForwardDest relays global requests sent by the client, recording the
+// remote port forwards granted by the target.
+type remoteForwardDest struct {
+	requestDest
+	forwards *remoteForwards
+}
+
+func (d remoteForwardDest) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	ok, reply, err := d.requestDest.SendRequest(name, wantReply, payload)
+	if ok && err == nil {
+		d.forwards.update(name, payload, reply)
+	}
+	return ok, reply, err
+}
+
+// clientGlobalRequestFilter returns the filter for global requests sent by
+// the client, combining GlobalRequestFilter with RemoteForwardFilter and
+// StripHostKeyExtensions.
+func (c *proxyConn) clientGlobalRequestFilter() requestFilter {
+	if c.proxy.RemoteForwardFilter == nil && !c.proxy.StripHostKeyExtensions {
+		return c.proxy.GlobalRequestFilter
+	}
+	return func(ctx context.Context, reqType string, payload []byte) bool {
+		if reqType == tcpipForwardRequestType && c.proxy.RemoteForwardFilter != nil {
+			var msg tcpipForwardMsg
+			if err := ssh.Unmarshal(payload, &msg); err != nil || !c.proxy.RemoteForwardFilter(ctx, msg.BindAddr, msg.BindPort) {
+				return false
+			}
+		}
+		if c.proxy.StripHostKeyExtensions && isHostKeyExtension(reqType) {
+			return false
+		}
+		return c.proxy.GlobalRequestFilter == nil || c.proxy.GlobalRequestFilter(ctx, reqType, payload)
+	}
+}
+
+// CIDRForwardFilter returns a function, suitable for
+// ReverseProxy.ForwardFilter, that allows forwarding to any port of IP
+// addresses within the given CIDR ranges, such as "10.0.0.0/8". Host names
+// are not allowed, as they are resolved by the target.
+func CIDRForwardFilter(cidrs ...string) (func(ctx context.Context, destHost string, destPort uint32) bool, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("parse forward filter cidr: %w", err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return func(_ context.Context, destHost string, destPort uint32) bool {
+		ip := net.ParseIP(destHost)
+		if ip == nil {
+			return false
+		}
+		for _, ipNet := range nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
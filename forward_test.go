@@ -0,0 +1,186 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_forwardFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	filter, err := CIDRForwardFilter("127.0.0.0/8")
+	if err != nil {
+		t.Fatalf("new forward filter: %v", err)
+	}
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.ForwardFilter = filter
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	// allowed
+	left, right, err := tcpPipeWithDialer(client.Dial, net.Listen)
+	if err != nil {
+		t.Fatalf("forward to allowed address: %v", err)
+	}
+	testConnPipe(t, left, right)
+
+	// denied
+	for _, addr := range []string{"10.0.0.1:22", "localhost:22"} {
+		_, err = client.Dial("tcp", addr)
+		var openChanErr *ssh.OpenChannelError
+		if !errors.As(err, &openChanErr) || openChanErr.Reason != ssh.Prohibited {
+			t.Fatalf("expected forward to %s to be prohibited, got: %v", addr, err)
+		}
+	}
+
+	// forwards to unix sockets cannot be judged by the filter
+	_, err = client.Dial("unix", "/tmp/target.sock")
+	var openChanErr *ssh.OpenChannelError
+	if !errors.As(err, &openChanErr) || openChanErr.Reason != ssh.Prohibited {
+		t.Fatalf("expected forward to unix socket to be prohibited, got: %v", err)
+	}
+}
+
+func Test_cidrForwardFilter(t *testing.T) {
+	if _, err := CIDRForwardFilter("not a cidr"); err == nil {
+		t.Fatalf("expected error parsing invalid cidr")
+	}
+	filter, err := CIDRForwardFilter("10.0.0.0/8", "fd00::/8")
+	if err != nil {
+		t.Fatalf("new forward filter: %v", err)
+	}
+	for host, expected := range map[string]bool{
+		"10.1.2.3":    true,
+		"fd00::1":     true,
+		"192.168.0.1": false,
+		"internal":    false,
+	} {
+		if filter(context.Background(), host, 22) != expected {
+			t.Fatalf("unexpected result for %s, expected %v", host, expected)
+		}
+	}
+}
+
+func Test_remoteForwardFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, serveRemoteForwards)
+
+	var requested []uint32
+	proxy := New(backendAddr, testClientConfig())
+	proxy.RemoteForwardFilter = func(_ context.Context, bindAddr string, bindPort uint32) bool {
+		requested = append(requested, bindPort)
+		return bindPort == 0 || bindPort >= 8000
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	l, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("remote forward with allocated port: %v", err)
+	}
+	if port := l.Addr().(*net.TCPAddr).Port; port != testAllocatedPort {
+		t.Fatalf("expected allocated port %d to be relayed, got %d", testAllocatedPort, port)
+	}
+	l.Close()
+
+	l, err = client.Listen("tcp", "127.0.0.1:8022")
+	if err != nil {
+		t.Fatalf("remote forward to allowed port: %v", err)
+	}
+	l.Close()
+
+	if _, err := client.Listen("tcp", "127.0.0.1:22"); err == nil {
+		t.Fatalf("expected remote forward to denied port to be rejected")
+	}
+	if len(requested) != 3 {
+		t.Fatalf("expected filter to be called for each request, got %v", requested)
+	}
+}
+
+// testAllocatedPort is the port allocated by serveRemoteForwards when port 0
+// is requested.
+const testAllocatedPort = 4242
+
+// serveRemoteForwards is a backendHandler granting every "tcpip-forward" and
+// "cancel-tcpip-forward" request, without opening any forwarded channels.
+func serveRemoteForwards(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				var msg tcpipForwardMsg
+				if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				if msg.BindPort == 0 {
+					_ = req.Reply(true, ssh.Marshal(struct{ Port uint32 }{testAllocatedPort}))
+					continue
+				}
+				_ = req.Reply(true, nil)
+			case "cancel-tcpip-forward":
+				_ = req.Reply(true, nil)
+			default:
+				_ = req.Reply(false, nil)
+			}
+		}
+	}()
+	for newCh := range chans {
+		_ = newCh.Reject(ssh.Prohibited, "")
+	}
+}
+
+func Test_remoteForwardsFromContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, ok := RemoteForwardsFromContext(ctx); ok {
+		t.Fatalf("expected no remote forwards in background context")
+	}
+
+	// each "marker" request reports the forwards granted so far
+	granted := make(chan []RemoteForward, 1)
+	proxy := New(newTestBackend(t, serveRemoteForwards), testClientConfig())
+	proxy.Hooks = &Hooks{
+		OnRequest: func(ctx context.Context, reqType string, wantReply bool) {
+			if reqType == "marker" {
+				forwards, _ := RemoteForwardsFromContext(ctx)
+				granted <- forwards
+			}
+		},
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	forwardsAfter := func() []RemoteForward {
+		t.Helper()
+		if _, _, err := client.SendRequest("marker", true, nil); err != nil {
+			t.Fatalf("send marker request: %v", err)
+		}
+		return <-granted
+	}
+
+	allocated, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("remote forward with allocated port: %v", err)
+	}
+	defer allocated.Close()
+	fixed, err := client.Listen("tcp", "127.0.0.1:8022")
+	if err != nil {
+		t.Fatalf("remote forward to fixed port: %v", err)
+	}
+	expected := []RemoteForward{{"127.0.0.1", testAllocatedPort}, {"127.0.0.1", 8022}}
+	if forwards := forwardsAfter(); !reflect.DeepEqual(forwards, expected) {
+		t.Fatalf("expected forwards %v, got %v", expected, forwards)
+	}
+
+	fixed.Close()
+	expected = expected[:1]
+	if forwards := forwardsAfter(); !reflect.DeepEqual(forwards, expected) {
+		t.Fatalf("expected cancelled forward to be removed, got %v", forwards)
+	}
+}
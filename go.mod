@@ -2,6 +2,9 @@ module github.com/cmoog/sshproxy
 
 go 1.18
 
-require golang.org/x/crypto v0.12.0
+require (
+	golang.org/x/crypto v0.12.0
+	golang.org/x/net v0.14.0
+)
 
 require golang.org/x/sys v0.11.0 // indirect
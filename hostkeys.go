@@ -0,0 +1,65 @@
+package sshproxy
+
+import (
+	"context"
+	"crypto/rsa"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH host key rotation extensions, as described in section 2.5 of
+// OpenSSH's PROTOCOL file.
+const (
+	hostKeysRequestType      = "hostkeys-00@openssh.com"
+	hostKeysProveRequestType = "hostkeys-prove-00@openssh.com"
+)
+
+// isHostKeyExtension reports whether reqType is a global request
+// of the OpenSSH host key rotation extensions.
+func isHostKeyExtension(reqType string) bool {
+	return reqType == hostKeysRequestType || reqType == hostKeysProveRequestType
+}
+
+// targetGlobalRequestFilter returns the filter for global requests sent by
+// the target, which strips the host key extensions if StripHostKeyExtensions
+// is set.
+func (c *proxyConn) targetGlobalRequestFilter() requestFilter {
+	if !c.proxy.StripHostKeyExtensions {
+		return nil
+	}
+	return func(_ context.Context, reqType string, payload []byte) bool {
+		return !isHostKeyExtension(reqType)
+	}
+}
+
+// minRSAHostKeyBits is the size below which RSA host keys are weak.
+const minRSAHostKeyBits = 2048
+
+// isWeakHostKey reports whether key uses a deprecated algorithm, which
+// includes DSA keys and RSA keys shorter than minRSAHostKeyBits.
+func isWeakHostKey(key ssh.PublicKey) bool {
+	switch key.Type() {
+	case ssh.KeyAlgoDSA:
+		return true
+	case ssh.KeyAlgoRSA:
+		if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+			if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok {
+				return rsaKey.N.BitLen() < minRSAHostKeyBits
+			}
+		}
+	}
+	return false
+}
+
+// checkHostKey reports a weak host key presented by the target at addr
+// to OnWeakHostKey, the log, and the event logger.
+func (c *proxyConn) checkHostKey(addr string, key ssh.PublicKey) {
+	if !isWeakHostKey(key) {
+		return
+	}
+	c.logger.Warn("sshproxy: ReverseProxy target %s presented weak %s host key", addr, key.Type())
+	c.logEvent(Event{Type: EventWeakHostKey, HostKeyType: key.Type()})
+	if c.proxy.OnWeakHostKey != nil {
+		c.proxy.OnWeakHostKey(key.Type(), addr)
+	}
+}
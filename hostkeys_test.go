@@ -0,0 +1,137 @@
+package sshproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_stripHostKeyExtensions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go func() {
+			for req := range reqs {
+				_ = req.Reply(true, nil)
+			}
+		}()
+		_, _, _ = conn.SendRequest(hostKeysRequestType, false, []byte("keys"))
+		_, _, _ = conn.SendRequest("marker", false, nil)
+		for newCh := range chans {
+			_ = newCh.Reject(ssh.Prohibited, "")
+		}
+	})
+	proxy := New(backendAddr, testClientConfig())
+	proxy.StripHostKeyExtensions = true
+
+	left, right, err := tcpPipeWithDialer(net.Dial, net.Listen)
+	if err != nil {
+		t.Fatalf("new net pipe: %v", err)
+	}
+	defer left.Close()
+	defer right.Close()
+
+	signer, err := generateSigner()
+	if err != nil {
+		t.Fatalf("generate signer: %v", err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+	go func() {
+		serverConn, chans, reqs, err := ssh.NewServerConn(right, serverConfig)
+		if err != nil {
+			return
+		}
+		_ = proxy.Serve(ctx, serverConn, chans, reqs)
+	}()
+
+	// a raw client connection observes every global request from the target
+	clientConn, chans, reqs, err := ssh.NewClientConn(left, "localhost", testClientConfig())
+	if err != nil {
+		t.Fatalf("new client conn: %v", err)
+	}
+	defer clientConn.Close()
+	go func() {
+		for newCh := range chans {
+			_ = newCh.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	select {
+	case req := <-reqs:
+		if req.Type != "marker" {
+			t.Fatalf("expected %s from the target to be stripped, got %s", hostKeysRequestType, req.Type)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected global request from the target")
+	}
+
+	for reqType, expected := range map[string]bool{hostKeysProveRequestType: false, "other": true} {
+		ok, _, err := clientConn.SendRequest(reqType, true, nil)
+		if err != nil {
+			t.Fatalf("send request: %v", err)
+		}
+		if ok != expected {
+			t.Fatalf("unexpected reply to %q, expected %v, got %v", reqType, expected, ok)
+		}
+	}
+}
+
+func Test_weakHostKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("new signer: %v", err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	backendAddr := newTestBackendWithConfig(t, config, serveSessions)
+
+	type weakKey struct{ algo, addr string }
+	reported := make(chan weakKey, 1)
+	clientConfig := testClientConfig()
+	clientConfig.HostKeyAlgorithms = []string{ssh.KeyAlgoRSASHA256}
+	proxy := New(backendAddr, clientConfig)
+	proxy.OnWeakHostKey = func(algo string, addr string) {
+		reported <- weakKey{algo, addr}
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+
+	if weak := <-reported; weak != (weakKey{ssh.KeyAlgoRSA, backendAddr}) {
+		t.Fatalf("unexpected weak host key report: %+v", weak)
+	}
+}
+
+func Test_isWeakHostKey(t *testing.T) {
+	signer, err := generateSigner()
+	if err != nil {
+		t.Fatalf("generate signer: %v", err)
+	}
+	if isWeakHostKey(signer.PublicKey()) {
+		t.Fatalf("expected %s host key not to be weak", signer.PublicKey().Type())
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("new public key: %v", err)
+	}
+	if isWeakHostKey(pub) {
+		t.Fatalf("expected 2048 bit rsa host key not to be weak")
+	}
+}
@@ -0,0 +1,82 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpDialer returns a function, suitable for ReverseProxy.Dial, that reaches
+// the target through an intermediate SSH server, like OpenSSH's ProxyJump.
+// Each dial establishes a new SSH connection to jumpAddr using jumpConfig and
+// opens a "direct-tcpip" channel to the target address. Closing the returned
+// net.Conn also closes the connection to the jump host.
+func JumpDialer(jumpAddr string, jumpConfig *ssh.ClientConfig) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialer := net.Dialer{Timeout: jumpConfig.Timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", jumpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("dial jump host: %w", err)
+		}
+
+		// bound the handshake by the context
+		handshakeDone := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = conn.SetDeadline(time.Unix(1, 0))
+			case <-handshakeDone:
+			}
+		}()
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, jumpAddr, jumpConfig)
+		close(handshakeDone)
+		if ctx.Err() != nil {
+			conn.Close()
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("jump host ssh client conn: %w", err)
+		}
+
+		client := ssh.NewClient(sshConn, chans, reqs)
+		type dialResult struct {
+			conn net.Conn
+			err  error
+		}
+		// bound the channel open by the context, closing the client on
+		// cancellation to unblock the dial and close any late channel
+		dialed := make(chan dialResult, 1)
+		go func() {
+			conn, err := client.Dial(network, addr)
+			dialed <- dialResult{conn, err}
+		}()
+		select {
+		case <-ctx.Done():
+			client.Close()
+			return nil, ctx.Err()
+		case res := <-dialed:
+			if res.err != nil {
+				client.Close()
+				return nil, fmt.Errorf("dial through jump host: %w", res.err)
+			}
+			return &jumpConn{Conn: res.conn, client: client}, nil
+		}
+	}
+}
+
+// jumpConn is a connection through a jump host, which
+// closes the connection to the jump host when closed.
+type jumpConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	_ = c.client.Close()
+	return err
+}
@@ -0,0 +1,63 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_jumpDialer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the jump host forwards direct-tcpip channels to the target
+	var jumped int32
+	jumpAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		atomic.AddInt32(&jumped, 1)
+		serveSessions(conn, chans, reqs)
+	})
+	targetAddr := newTestBackend(t, serveSessions)
+
+	proxy := New(targetAddr, testClientConfig())
+	proxy.Dial = JumpDialer(jumpAddr, testClientConfig())
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+	testStdin(t, client)
+	client.Close()
+	<-serveErr
+
+	if n := atomic.LoadInt32(&jumped); n != 1 {
+		t.Fatalf("expected 1 connection to the jump host, got %d", n)
+	}
+}
+
+func Test_jumpDialerUnreachableTarget(t *testing.T) {
+	jumpAddr := newTestBackend(t, serveSessions)
+
+	dial := JumpDialer(jumpAddr, testClientConfig())
+	_, err := dial(context.Background(), "tcp", "127.0.0.1:1")
+	if err == nil {
+		t.Fatalf("expected error dialing an unreachable target")
+	}
+}
+
+func Test_jumpDialerCancel(t *testing.T) {
+	// the jump host never answers the channel open
+	jumpAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for range chans {
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	dial := JumpDialer(jumpAddr, testClientConfig())
+	_, err := dial(ctx, "tcp", "127.0.0.1:22")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded opening the channel, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package sshproxy
+
+import (
+	"log"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	// LevelDebug is for messages about expected failures, such as
+	// channel copies interrupted by the other side closing.
+	LevelDebug LogLevel = iota - 1
+	// LevelInfo is the default LogLevel.
+	LevelInfo
+	// LevelWarn is for failures affecting a single channel or request.
+	LevelWarn
+	// LevelError is for failures affecting the whole connection.
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// LeveledLogger is a logger with a method for each LogLevel. The arguments
+// of each method are formatted in the manner of fmt.Printf.
+type LeveledLogger interface {
+	Debug(format string, v ...any)
+	Info(format string, v ...any)
+	Warn(format string, v ...any)
+	Error(format string, v ...any)
+}
+
+// printfLogger adapts a *log.Logger to a LeveledLogger, discarding messages
+// below the minimum level.
+type printfLogger struct {
+	logger *log.Logger
+	level  LogLevel
+}
+
+func (l printfLogger) printf(level LogLevel, format string, v ...any) {
+	if level < l.level {
+		return
+	}
+	if l.logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	l.logger.Printf(format, v...)
+}
+
+func (l printfLogger) Debug(format string, v ...any) { l.printf(LevelDebug, format, v...) }
+func (l printfLogger) Info(format string, v ...any)  { l.printf(LevelInfo, format, v...) }
+func (l printfLogger) Warn(format string, v ...any)  { l.printf(LevelWarn, format, v...) }
+func (l printfLogger) Error(format string, v ...any) { l.printf(LevelError, format, v...) }
+
+// logger returns the configured Logger, or else adapts ErrorLog or the
+// standard logger, gated by LogLevel.
+func (r *ReverseProxy) logger() LeveledLogger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return printfLogger{logger: r.ErrorLog, level: r.LogLevel}
+}
@@ -0,0 +1,72 @@
+package sshproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// levelRecorder is a LeveledLogger that records messages by level.
+type levelRecorder struct {
+	mu       sync.Mutex
+	messages map[LogLevel][]string
+}
+
+func (l *levelRecorder) record(level LogLevel, format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.messages == nil {
+		l.messages = make(map[LogLevel][]string)
+	}
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(format, v...))
+}
+
+func (l *levelRecorder) Debug(format string, v ...any) { l.record(LevelDebug, format, v...) }
+func (l *levelRecorder) Info(format string, v ...any)  { l.record(LevelInfo, format, v...) }
+func (l *levelRecorder) Warn(format string, v ...any)  { l.record(LevelWarn, format, v...) }
+func (l *levelRecorder) Error(format string, v ...any) { l.record(LevelError, format, v...) }
+
+func Test_leveledLogger(t *testing.T) {
+	logger := &levelRecorder{}
+	proxy := New("127.0.0.1:1", testClientConfig())
+	proxy.Logger = logger
+	if err := proxy.Serve(context.Background(), nil, nil, nil); err == nil {
+		t.Fatalf("expected error from reverse proxy")
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	errs := logger.messages[LevelError]
+	if len(errs) != 1 || !strings.Contains(errs[0], "dial reverse proxy target") {
+		t.Fatalf("expected dial failure to be logged as an error, got %v", logger.messages)
+	}
+}
+
+func Test_logLevel(t *testing.T) {
+	tests := []struct {
+		level    LogLevel
+		expected string
+	}{
+		{LevelDebug, "debug\ninfo\nwarn\nerror\n"},
+		{LevelInfo, "info\nwarn\nerror\n"},
+		{LevelError, "error\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			proxy := &ReverseProxy{ErrorLog: log.New(&buf, "", 0), LogLevel: tt.level}
+			logger := proxy.logger()
+			logger.Debug("debug")
+			logger.Info("info")
+			logger.Warn("warn")
+			logger.Error("error")
+			if buf.String() != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, buf.String())
+			}
+		})
+	}
+}
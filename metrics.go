@@ -0,0 +1,74 @@
+package sshproxy
+
+import (
+	"time"
+)
+
+// Direction identifies the direction in which channel data is proxied.
+type Direction int
+
+const (
+	// ClientToTarget is data sent by the client to the target.
+	ClientToTarget Direction = iota
+	// TargetToClient is data sent by the target to the client.
+	TargetToClient
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToTarget:
+		return "client_to_target"
+	case TargetToClient:
+		return "target_to_client"
+	default:
+		return "unknown"
+	}
+}
+
+// Metrics receives measurements of proxied connections, such that they may
+// be exported to a metrics system without this package depending on it.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// IncActiveConnections and DecActiveConnections are called when the
+	// connection to the target is established and when Serve returns.
+	IncActiveConnections()
+	DecActiveConnections()
+	// ObserveSessionDuration is called with the duration of each connection
+	// once Serve returns.
+	ObserveSessionDuration(d time.Duration)
+	// IncChannelsByType is called for each channel that is successfully
+	// opened in either direction.
+	IncChannelsByType(channelType string)
+	// AddBytes is called with the number of bytes proxied in each direction
+	// once a channel is closed.
+	AddBytes(dir Direction, n int64)
+	// ObserveChannelOpenLatency is called with the time taken by the target
+	// to confirm or reject each channel opened by the client. High latency
+	// often indicates a struggling target, or for "direct-tcpip" channels,
+	// a slow forwarding destination.
+	ObserveChannelOpenLatency(channelType string, d time.Duration)
+	// ObserveBackendHandshakeLatency is called with the time taken to dial
+	// and complete the SSH handshake with the target, or to return from
+	// DialClient, for each successful connection attempt.
+	ObserveBackendHandshakeLatency(d time.Duration)
+}
+
+// nopMetrics is the Metrics used when ReverseProxy.Metrics is nil.
+type nopMetrics struct{}
+
+func (nopMetrics) IncActiveConnections()                {}
+func (nopMetrics) DecActiveConnections()                {}
+func (nopMetrics) ObserveSessionDuration(time.Duration) {}
+func (nopMetrics) IncChannelsByType(string)             {}
+func (nopMetrics) AddBytes(Direction, int64)            {}
+
+func (nopMetrics) ObserveChannelOpenLatency(string, time.Duration) {}
+func (nopMetrics) ObserveBackendHandshakeLatency(time.Duration)    {}
+
+// metrics returns the configured Metrics, or a no-op implementation.
+func (r *ReverseProxy) metrics() Metrics {
+	if r.Metrics != nil {
+		return r.Metrics
+	}
+	return nopMetrics{}
+}
@@ -0,0 +1,154 @@
+package sshproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// counterMetrics is an example Metrics adapter backed by simple counters,
+// in the way one might back it with a metrics library.
+type counterMetrics struct {
+	mu        sync.Mutex
+	active    int64
+	sessions  []time.Duration
+	channels  map[string]int64
+	bytes     map[Direction]int64
+	bytesDone chan struct{}
+	opens     map[string][]time.Duration
+	dials     []time.Duration
+}
+
+func newCounterMetrics() *counterMetrics {
+	return &counterMetrics{
+		channels:  make(map[string]int64),
+		bytes:     make(map[Direction]int64),
+		bytesDone: make(chan struct{}, 2),
+		opens:     make(map[string][]time.Duration),
+	}
+}
+
+func (m *counterMetrics) IncActiveConnections() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active++
+}
+
+func (m *counterMetrics) DecActiveConnections() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+}
+
+func (m *counterMetrics) ObserveSessionDuration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions = append(m.sessions, d)
+}
+
+func (m *counterMetrics) IncChannelsByType(channelType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.channels[channelType]++
+}
+
+func (m *counterMetrics) AddBytes(dir Direction, n int64) {
+	m.mu.Lock()
+	m.bytes[dir] += n
+	m.mu.Unlock()
+	m.bytesDone <- struct{}{}
+}
+
+func (m *counterMetrics) ObserveChannelOpenLatency(channelType string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.opens[channelType] = append(m.opens[channelType], d)
+}
+
+func (m *counterMetrics) ObserveBackendHandshakeLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dials = append(m.dials, d)
+}
+
+func Test_metrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metrics := newCounterMetrics()
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.Metrics = metrics
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testStdin(t, client)
+	<-metrics.bytesDone
+	<-metrics.bytesDone
+
+	metrics.mu.Lock()
+	if metrics.active != 1 {
+		t.Errorf("expected 1 active connection, got %d", metrics.active)
+	}
+	if metrics.channels["session"] != 1 {
+		t.Errorf("expected 1 session channel, got %v", metrics.channels)
+	}
+	if metrics.bytes[ClientToTarget] != 8 || metrics.bytes[TargetToClient] != 8 {
+		t.Errorf("unexpected bytes, got %v", metrics.bytes)
+	}
+	metrics.mu.Unlock()
+
+	client.Close()
+	<-serveErr
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.active != 0 || len(metrics.sessions) != 1 || metrics.sessions[0] <= 0 {
+		t.Fatalf("unexpected connection metrics, got %d active and sessions %v", metrics.active, metrics.sessions)
+	}
+}
+
+func Test_metricsLatency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const delay = 50 * time.Millisecond
+	// the backend is slow to confirm channels
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		delayed := make(chan ssh.NewChannel)
+		go func() {
+			defer close(delayed)
+			for newCh := range chans {
+				time.Sleep(delay)
+				delayed <- newCh
+			}
+		}()
+		serveSessions(conn, delayed, reqs)
+	})
+	metrics := newCounterMetrics()
+	proxy := New(backendAddr, testClientConfig())
+	proxy.Metrics = metrics
+	// and slow to dial
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		time.Sleep(delay)
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	session.Close()
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if len(metrics.dials) != 1 || metrics.dials[0] < delay || metrics.dials[0] > 3*time.Second {
+		t.Errorf("expected 1 handshake of at least %v, got %v", delay, metrics.dials)
+	}
+	opens := metrics.opens["session"]
+	if len(opens) != 1 || opens[0] < delay || opens[0] > 3*time.Second {
+		t.Errorf("expected 1 session channel open of at least %v, got %v", delay, opens)
+	}
+}
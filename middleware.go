@@ -0,0 +1,82 @@
+package sshproxy
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Handler serves a single SSH connection whose handshake has completed.
+// *ReverseProxy is a Handler.
+type Handler interface {
+	Serve(ctx context.Context, serverConn *ssh.ServerConn, serverChans <-chan ssh.NewChannel, serverReqs <-chan *ssh.Request) error
+}
+
+var _ Handler = (*ReverseProxy)(nil)
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(ctx context.Context, serverConn *ssh.ServerConn, serverChans <-chan ssh.NewChannel, serverReqs <-chan *ssh.Request) error
+
+// Serve calls f.
+func (f HandlerFunc) Serve(ctx context.Context, serverConn *ssh.ServerConn, serverChans <-chan ssh.NewChannel, serverReqs <-chan *ssh.Request) error {
+	return f(ctx, serverConn, serverChans, serverReqs)
+}
+
+// Middleware wraps a Handler with additional behavior, such as to observe,
+// filter, or reject connections before calling next.
+type Middleware func(next Handler) Handler
+
+// Chain composes middlewares into one, such that the first middleware is the
+// outermost, called first with each connection.
+func Chain(mw ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			next = mw[i](next)
+		}
+		return next
+	}
+}
+
+// LoggingMiddleware logs each connection served by the wrapped Handler when
+// it starts and when it ends, along with its duration and error.
+func LoggingMiddleware(logger LeveledLogger) Middleware {
+	return loggingMiddleware(logger, realClock{})
+}
+
+func loggingMiddleware(logger LeveledLogger, clk clock) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, serverConn *ssh.ServerConn, serverChans <-chan ssh.NewChannel, serverReqs <-chan *ssh.Request) error {
+			client := "unknown client"
+			if serverConn != nil {
+				client = serverConn.User() + "@" + serverConn.RemoteAddr().String()
+			}
+			logger.Info("sshproxy: serve %s", client)
+			start := clk.Now()
+			err := next.Serve(ctx, serverConn, serverChans, serverReqs)
+			logger.Info("sshproxy: served %s for %v: %v", client, clk.Now().Sub(start), err)
+			return err
+		})
+	}
+}
+
+// MetricsMiddleware reports each connection served by the wrapped Handler to
+// metrics as active until it returns, and observes its duration. Unlike
+// ReverseProxy.Metrics, it also counts connections that fail before the
+// target is connected.
+func MetricsMiddleware(metrics Metrics) Middleware {
+	return metricsMiddleware(metrics, realClock{})
+}
+
+func metricsMiddleware(metrics Metrics, clk clock) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, serverConn *ssh.ServerConn, serverChans <-chan ssh.NewChannel, serverReqs <-chan *ssh.Request) error {
+			metrics.IncActiveConnections()
+			start := clk.Now()
+			defer func() {
+				metrics.DecActiveConnections()
+				metrics.ObserveSessionDuration(clk.Now().Sub(start))
+			}()
+			return next.Serve(ctx, serverConn, serverChans, serverReqs)
+		})
+	}
+}
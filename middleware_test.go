@@ -0,0 +1,84 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_chain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, serverConn *ssh.ServerConn, serverChans <-chan ssh.NewChannel, serverReqs <-chan *ssh.Request) error {
+				calls = append(calls, name)
+				return next.Serve(ctx, serverConn, serverChans, serverReqs)
+			})
+		}
+	}
+	errServed := errors.New("served")
+	handler := Chain(trace("outer"), trace("inner"))(HandlerFunc(func(context.Context, *ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request) error {
+		calls = append(calls, "handler")
+		return errServed
+	}))
+
+	if err := handler.Serve(context.Background(), nil, nil, nil); !errors.Is(err, errServed) {
+		t.Fatalf("expected handler error, got: %v", err)
+	}
+	if expected := []string{"outer", "inner", "handler"}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected calls %q, got %q", expected, calls)
+	}
+}
+
+func Test_chainMiddlewares(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := &levelRecorder{}
+	metrics := newCounterMetrics()
+	var handler Handler = New(newTestBackend(t, serveSessions), testClientConfig())
+	handler = Chain(LoggingMiddleware(logger), MetricsMiddleware(metrics))(handler)
+
+	client, serveErr := newServedClient(t, func(serverConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) error {
+		return handler.Serve(ctx, serverConn, chans, reqs)
+	})
+	testSessionExec(t, client)
+	client.Close()
+	<-serveErr
+
+	metrics.mu.Lock()
+	if metrics.active != 0 || len(metrics.sessions) != 1 {
+		t.Fatalf("expected 1 completed connection, got %d active and %d sessions", metrics.active, len(metrics.sessions))
+	}
+	metrics.mu.Unlock()
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	infos := logger.messages[LevelInfo]
+	if len(infos) != 2 || !strings.HasPrefix(infos[0], "sshproxy: serve ") || !strings.HasPrefix(infos[1], "sshproxy: served ") {
+		t.Fatalf("expected the start and end of the connection to be logged, got %q", infos)
+	}
+}
+
+func Test_metricsMiddlewareFakeClock(t *testing.T) {
+	clk := newFakeClock()
+	metrics := newCounterMetrics()
+	handler := metricsMiddleware(metrics, clk)(HandlerFunc(func(context.Context, *ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request) error {
+		clk.Advance(5 * time.Second)
+		return nil
+	}))
+	if err := handler.Serve(context.Background(), nil, nil, nil); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if len(metrics.sessions) != 1 || metrics.sessions[0] != 5*time.Second {
+		t.Fatalf("expected a session duration of 5s, got %v", metrics.sessions)
+	}
+}
@@ -0,0 +1,299 @@
+package sshproxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// An Option configures a ReverseProxy. Each option sets the ReverseProxy
+// field of the same name, such that every configurable field has an option.
+type Option func(*ReverseProxy)
+
+// WithTargetResolver sets TargetResolver.
+func WithTargetResolver(resolve func(ctx context.Context, serverConn *ssh.ServerConn) (addr string, config *ssh.ClientConfig, err error)) Option {
+	return func(r *ReverseProxy) { r.TargetResolver = resolve }
+}
+
+// WithNetwork sets Network.
+func WithNetwork(network string) Option {
+	return func(r *ReverseProxy) { r.Network = network }
+}
+
+// WithDialer sets Dial.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(r *ReverseProxy) { r.Dial = dial }
+}
+
+// WithErrorLog sets ErrorLog.
+func WithErrorLog(l *log.Logger) Option {
+	return func(r *ReverseProxy) { r.ErrorLog = l }
+}
+
+// WithLogger sets Logger.
+func WithLogger(l LeveledLogger) Option {
+	return func(r *ReverseProxy) { r.Logger = l }
+}
+
+// WithLogLevel sets LogLevel.
+func WithLogLevel(level LogLevel) Option {
+	return func(r *ReverseProxy) { r.LogLevel = level }
+}
+
+// WithHooks sets Hooks.
+func WithHooks(h *Hooks) Option {
+	return func(r *ReverseProxy) { r.Hooks = h }
+}
+
+// WithKeepAlive sets KeepAlive.
+func WithKeepAlive(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.KeepAlive = d }
+}
+
+// WithChannelFilter sets ChannelFilter.
+func WithChannelFilter(filter func(ctx context.Context, channelType string, extraData []byte) bool) Option {
+	return func(r *ReverseProxy) { r.ChannelFilter = filter }
+}
+
+// WithTargetChannelFilter sets TargetChannelFilter.
+func WithTargetChannelFilter(filter func(ctx context.Context, channelType string, extraData []byte) bool) Option {
+	return func(r *ReverseProxy) { r.TargetChannelFilter = filter }
+}
+
+// WithInspectChannel sets InspectChannel.
+func WithInspectChannel(inspect func(ctx context.Context, channelType string, extraData []byte) error) Option {
+	return func(r *ReverseProxy) { r.InspectChannel = inspect }
+}
+
+// WithRequestFilter sets RequestFilter.
+func WithRequestFilter(filter func(ctx context.Context, reqType string, payload []byte) bool) Option {
+	return func(r *ReverseProxy) { r.RequestFilter = filter }
+}
+
+// WithGlobalRequestFilter sets GlobalRequestFilter.
+func WithGlobalRequestFilter(filter func(ctx context.Context, reqType string, payload []byte) bool) Option {
+	return func(r *ReverseProxy) { r.GlobalRequestFilter = filter }
+}
+
+// WithDisableAgentForwarding sets DisableAgentForwarding.
+func WithDisableAgentForwarding(disable bool) Option {
+	return func(r *ReverseProxy) { r.DisableAgentForwarding = disable }
+}
+
+// WithRecorder sets Recorder.
+func WithRecorder(rec Recorder) Option {
+	return func(r *ReverseProxy) { r.Recorder = rec }
+}
+
+// WithEvents sets Events.
+func WithEvents(events EventLogger) Option {
+	return func(r *ReverseProxy) { r.Events = events }
+}
+
+// WithBufferPool sets BufferPool.
+func WithBufferPool(pool BufferPool) Option {
+	return func(r *ReverseProxy) { r.BufferPool = pool }
+}
+
+// WithBufferSize sets BufferSize.
+func WithBufferSize(size int) Option {
+	return func(r *ReverseProxy) { r.BufferSize = size }
+}
+
+// WithNoStderrChannelTypes sets NoStderrChannelTypes.
+func WithNoStderrChannelTypes(channelTypes []string) Option {
+	return func(r *ReverseProxy) { r.NoStderrChannelTypes = channelTypes }
+}
+
+// WithHalfCloseGrace sets HalfCloseGrace.
+func WithHalfCloseGrace(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.HalfCloseGrace = d }
+}
+
+// WithDialAttempts sets DialAttempts.
+func WithDialAttempts(n int) Option {
+	return func(r *ReverseProxy) { r.DialAttempts = n }
+}
+
+// WithDialBackoff sets DialBackoff.
+func WithDialBackoff(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.DialBackoff = d }
+}
+
+// WithOnConnect sets OnConnect.
+func WithOnConnect(fn func(info ConnInfo)) Option {
+	return func(r *ReverseProxy) { r.OnConnect = fn }
+}
+
+// WithOnDisconnect sets OnDisconnect.
+func WithOnDisconnect(fn func(info ConnInfo, err error)) Option {
+	return func(r *ReverseProxy) { r.OnDisconnect = fn }
+}
+
+// WithWriteTimeout sets WriteTimeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.WriteTimeout = d }
+}
+
+// WithIdleTimeout sets IdleTimeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.IdleTimeout = d }
+}
+
+// WithMaxInFlightBytes sets MaxInFlightBytes.
+func WithMaxInFlightBytes(n int64) Option {
+	return func(r *ReverseProxy) { r.MaxInFlightBytes = n }
+}
+
+// WithRateLimitBytesPerSec sets RateLimitBytesPerSec.
+func WithRateLimitBytesPerSec(rate int64) Option {
+	return func(r *ReverseProxy) { r.RateLimitBytesPerSec = rate }
+}
+
+// WithRateLimitCombined sets RateLimitCombined.
+func WithRateLimitCombined(combined bool) Option {
+	return func(r *ReverseProxy) { r.RateLimitCombined = combined }
+}
+
+// WithDialClient sets DialClient.
+func WithDialClient(dial func(ctx context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error)) Option {
+	return func(r *ReverseProxy) { r.DialClient = dial }
+}
+
+// WithMetrics sets Metrics.
+func WithMetrics(m Metrics) Option {
+	return func(r *ReverseProxy) { r.Metrics = m }
+}
+
+// WithMaxSessionDuration sets MaxSessionDuration.
+func WithMaxSessionDuration(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.MaxSessionDuration = d }
+}
+
+// WithPtyRewrite sets PtyRewrite.
+func WithPtyRewrite(rewrite func(ctx context.Context, req PtyRequest) PtyRequest) Option {
+	return func(r *ReverseProxy) { r.PtyRewrite = rewrite }
+}
+
+// WithOnExit sets OnExit.
+func WithOnExit(fn func(ctx context.Context, channelType string, status ExitInfo)) Option {
+	return func(r *ReverseProxy) { r.OnExit = fn }
+}
+
+// WithExitRewrite sets ExitRewrite.
+func WithExitRewrite(rewrite func(ctx context.Context, channelType string, status ExitInfo) ExitInfo) Option {
+	return func(r *ReverseProxy) { r.ExitRewrite = rewrite }
+}
+
+// WithInjectEnv sets InjectEnv.
+func WithInjectEnv(env map[string]string) Option {
+	return func(r *ReverseProxy) { r.InjectEnv = env }
+}
+
+// WithDialTimeout sets DialTimeout.
+func WithDialTimeout(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.DialTimeout = d }
+}
+
+// WithClientVersionFilter sets ClientVersionFilter.
+func WithClientVersionFilter(filter func(ctx context.Context, version string) error) Option {
+	return func(r *ReverseProxy) { r.ClientVersionFilter = filter }
+}
+
+// WithForwardFilter sets ForwardFilter.
+func WithForwardFilter(filter func(ctx context.Context, destHost string, destPort uint32) bool) Option {
+	return func(r *ReverseProxy) { r.ForwardFilter = filter }
+}
+
+// WithRemoteForwardFilter sets RemoteForwardFilter.
+func WithRemoteForwardFilter(filter func(ctx context.Context, bindAddr string, bindPort uint32) bool) Option {
+	return func(r *ReverseProxy) { r.RemoteForwardFilter = filter }
+}
+
+// WithPreferredCiphers sets PreferredCiphers.
+func WithPreferredCiphers(ciphers []string) Option {
+	return func(r *ReverseProxy) { r.PreferredCiphers = ciphers }
+}
+
+// WithPreferredMACs sets PreferredMACs.
+func WithPreferredMACs(macs []string) Option {
+	return func(r *ReverseProxy) { r.PreferredMACs = macs }
+}
+
+// WithPreferredKeyExchanges sets PreferredKeyExchanges.
+func WithPreferredKeyExchanges(kexes []string) Option {
+	return func(r *ReverseProxy) { r.PreferredKeyExchanges = kexes }
+}
+
+// WithMaxChannelsPerConn sets MaxChannelsPerConn.
+func WithMaxChannelsPerConn(n int) Option {
+	return func(r *ReverseProxy) { r.MaxChannelsPerConn = n }
+}
+
+// WithAuthorizer sets Authorizer.
+func WithAuthorizer(authorize func(ctx context.Context, conn *ssh.ServerConn) error) Option {
+	return func(r *ReverseProxy) { r.Authorizer = authorize }
+}
+
+// WithClientAddrEnv sets ClientAddrEnv.
+func WithClientAddrEnv(name string) Option {
+	return func(r *ReverseProxy) { r.ClientAddrEnv = name }
+}
+
+// WithStripHostKeyExtensions sets StripHostKeyExtensions.
+func WithStripHostKeyExtensions(strip bool) Option {
+	return func(r *ReverseProxy) { r.StripHostKeyExtensions = strip }
+}
+
+// WithSubsystemFilter sets SubsystemFilter.
+func WithSubsystemFilter(filter func(ctx context.Context, name string) bool) Option {
+	return func(r *ReverseProxy) { r.SubsystemFilter = filter }
+}
+
+// WithSignalFilter sets SignalFilter.
+func WithSignalFilter(filter func(ctx context.Context, sig string) bool) Option {
+	return func(r *ReverseProxy) { r.SignalFilter = filter }
+}
+
+// WithCommandRewrite sets CommandRewrite.
+func WithCommandRewrite(rewrite func(ctx context.Context, cmd string) (string, error)) Option {
+	return func(r *ReverseProxy) { r.CommandRewrite = rewrite }
+}
+
+// WithOnWeakHostKey sets OnWeakHostKey.
+func WithOnWeakHostKey(fn func(algo string, addr string)) Option {
+	return func(r *ReverseProxy) { r.OnWeakHostKey = fn }
+}
+
+// WithReAuthInterval sets ReAuthInterval.
+func WithReAuthInterval(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.ReAuthInterval = d }
+}
+
+// WithReAuthTimeout sets ReAuthTimeout.
+func WithReAuthTimeout(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.ReAuthTimeout = d }
+}
+
+// WithReAuthVerify sets ReAuthVerify.
+func WithReAuthVerify(verify func(conn ssh.ConnMetadata, answer string) bool) Option {
+	return func(r *ReverseProxy) { r.ReAuthVerify = verify }
+}
+
+// WithEnforceCertOptions sets EnforceCertOptions.
+func WithEnforceCertOptions(enforce bool) Option {
+	return func(r *ReverseProxy) { r.EnforceCertOptions = enforce }
+}
+
+// WithConnDeadline sets ConnDeadline.
+func WithConnDeadline(d time.Duration) Option {
+	return func(r *ReverseProxy) { r.ConnDeadline = d }
+}
+
+// WithBackendAuthMessage sets BackendAuthMessage.
+func WithBackendAuthMessage(msg string) Option {
+	return func(r *ReverseProxy) { r.BackendAuthMessage = msg }
+}
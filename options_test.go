@@ -0,0 +1,73 @@
+package sshproxy
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_proxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, serveSessions)
+	opened := make(chan string, 2)
+	client, _ := newServedClient(t, func(serverConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) error {
+		return Proxy(ctx, serverConn, chans, reqs, backendAddr, testClientConfig(), WithHooks(&Hooks{
+			OnChannelOpen: func(_ context.Context, channelType string, extraData []byte) {
+				opened <- channelType
+			},
+		}))
+	})
+	testSessionExec(t, client)
+	if typ := <-opened; typ != "session" {
+		t.Fatalf("expected option to be applied, got opened channel type %s", typ)
+	}
+}
+
+func Test_newOptions(t *testing.T) {
+	filter := func(context.Context, string, []byte) bool { return true }
+	proxy := New("localhost:22", testClientConfig(),
+		WithIdleTimeout(time.Minute),
+		WithKeepAlive(time.Second),
+		WithChannelFilter(filter),
+	)
+	if proxy.TargetAddress != "localhost:22" || proxy.IdleTimeout != time.Minute || proxy.KeepAlive != time.Second || proxy.ChannelFilter == nil {
+		t.Fatalf("expected options to be applied, got %+v", proxy)
+	}
+}
+
+func Test_optionsCoverFields(t *testing.T) {
+	// every option sets a field directly, as in r.Field = value
+	file, err := parser.ParseFile(token.NewFileSet(), "options.go", nil, 0)
+	if err != nil {
+		t.Fatalf("parse options: %v", err)
+	}
+	set := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if assign, ok := n.(*ast.AssignStmt); ok {
+			if sel, ok := assign.Lhs[0].(*ast.SelectorExpr); ok {
+				set[sel.Sel.Name] = true
+			}
+		}
+		return true
+	})
+
+	typ := reflect.TypeOf(ReverseProxy{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		switch {
+		case !field.IsExported(), field.Name == "TargetAddress", field.Name == "TargetClientConfig":
+			continue
+		}
+		if !set[field.Name] {
+			t.Errorf("expected an option for field %s", field.Name)
+		}
+	}
+}
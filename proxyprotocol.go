@@ -0,0 +1,224 @@
+package sshproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidProxyHeader is returned when reading from a connection accepted by
+// a ProxyProtocolListener that did not begin with a valid PROXY protocol header.
+var ErrInvalidProxyHeader = errors.New("sshproxy: invalid PROXY protocol header")
+
+// ProxyProtocolListener wraps a net.Listener whose connections are prefixed
+// with a PROXY protocol v1 (text) or v2 (binary) header, as sent by many L4
+// load balancers. The header is required, and is read on first use of the
+// connection. RemoteAddr and LocalAddr of the accepted connections report the
+// addresses carried by the header, blocking until it has been read.
+// Connections with a missing or malformed header are closed.
+//
+// Wrap the listener before accepting connections for ssh.NewServerConn, so
+// that ssh.ServerConn.RemoteAddr reports the original client address.
+type ProxyProtocolListener struct {
+	net.Listener
+
+	// ReadHeaderTimeout optionally bounds the time allowed
+	// to read the header of each connection.
+	ReadHeaderTimeout time.Duration
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.ReadHeaderTimeout,
+	}, nil
+}
+
+// proxyProtocolConn lazily reads the PROXY protocol header of a connection.
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once          sync.Once
+	remote, local net.Addr
+	err           error
+}
+
+func (c *proxyProtocolConn) readHeader() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
+		}
+		c.remote, c.local, c.err = readProxyHeader(c.reader)
+		if c.err != nil {
+			_ = c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header, returning the source
+// and destination addresses it carries. Both addresses are nil if the header
+// does not carry addresses, such as for v1 "UNKNOWN" or v2 "LOCAL" headers.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// the shortest valid header is longer than the v2 signature
+	prefix, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+	switch {
+	case bytes.Equal(prefix, proxyProtocolV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	default:
+		return nil, nil, fmt.Errorf("%w: unrecognized signature", ErrInvalidProxyHeader)
+	}
+}
+
+// readProxyHeaderV1 reads a header such as "PROXY TCP4 192.0.2.1 192.0.2.2 56324 22\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// the header is at most 107 bytes, including the CRLF
+	const maxLength = 107
+	var line []byte
+	for len(line) < maxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("%w: v1 header is not terminated by CRLF", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: malformed v1 header", ErrInvalidProxyHeader)
+	}
+	srcAddr, err := parseProxyAddrV1(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parseProxyAddrV1(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyAddrV1(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: invalid %s address %q", ErrInvalidProxyHeader, proto, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid port %q", ErrInvalidProxyHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header, consisting of the signature, the
+// version and command, the address family and transport protocol, the length
+// of the remainder, and finally the addresses and any ignored TLVs.
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, versionCommand>>4)
+	}
+	switch versionCommand & 0xf {
+	case 0x0: // LOCAL, such as health checks from the load balancer itself
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidProxyHeader, versionCommand&0xf)
+	}
+
+	newAddr := func(ip net.IP, port uint16) net.Addr {
+		if family&0xf == 0x2 { // DGRAM
+			return &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+	switch family >> 4 {
+	case 0x0: // UNSPEC
+		return nil, nil, nil
+	case 0x1: // INET
+		if len(body) < 12 {
+			return nil, nil, fmt.Errorf("%w: short IPv4 address block", ErrInvalidProxyHeader)
+		}
+		return newAddr(net.IP(body[0:4]), binary.BigEndian.Uint16(body[8:10])),
+			newAddr(net.IP(body[4:8]), binary.BigEndian.Uint16(body[10:12])), nil
+	case 0x2: // INET6
+		if len(body) < 36 {
+			return nil, nil, fmt.Errorf("%w: short IPv6 address block", ErrInvalidProxyHeader)
+		}
+		return newAddr(net.IP(body[0:16]), binary.BigEndian.Uint16(body[32:34])),
+			newAddr(net.IP(body[16:32]), binary.BigEndian.Uint16(body[34:36])), nil
+	case 0x3: // UNIX
+		if len(body) < 216 {
+			return nil, nil, fmt.Errorf("%w: short unix address block", ErrInvalidProxyHeader)
+		}
+		unixAddr := func(b []byte) net.Addr {
+			return &net.UnixAddr{Name: string(bytes.TrimRight(b, "\x00")), Net: "unix"}
+		}
+		return unixAddr(body[0:108]), unixAddr(body[108:216]), nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported address family %d", ErrInvalidProxyHeader, family>>4)
+	}
+}
@@ -0,0 +1,139 @@
+package sshproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func proxyHeaderV2(command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func Test_proxyProtocolListener(t *testing.T) {
+	ipv4Addrs := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0, 22}
+	ipv6Addrs := make([]byte, 36)
+	copy(ipv6Addrs, net.ParseIP("2001:db8::1"))
+	copy(ipv6Addrs[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6Addrs[32:], 56324)
+	binary.BigEndian.PutUint16(ipv6Addrs[34:], 22)
+
+	tests := []struct {
+		name   string
+		header []byte
+		// remote is the expected remote address, or empty for the real address
+		remote string
+	}{
+		{"v1_tcp4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 22\r\n"), "192.0.2.1:56324"},
+		{"v1_tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n"), "[2001:db8::1]:56324"},
+		{"v1_unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2_ipv4", proxyHeaderV2(0x1, 0x11, ipv4Addrs), "192.0.2.1:56324"},
+		{"v2_ipv6", proxyHeaderV2(0x1, 0x21, ipv6Addrs), "[2001:db8::1]:56324"},
+		{"v2_local", proxyHeaderV2(0x0, 0x00, nil), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := proxyProtocolPipe(t)
+			go func() {
+				_, _ = client.Write(append(tt.header, "payload"...))
+			}()
+
+			expected := tt.remote
+			if expected == "" {
+				expected = client.LocalAddr().String()
+			}
+			if remote := server.RemoteAddr().String(); remote != expected {
+				t.Fatalf("unexpected remote address, expected %s, got %s", expected, remote)
+			}
+			payload := make([]byte, len("payload"))
+			if _, err := io.ReadFull(server, payload); err != nil {
+				t.Fatalf("read payload: %v", err)
+			}
+			if string(payload) != "payload" {
+				t.Fatalf("unexpected payload, got %q", payload)
+			}
+		})
+	}
+}
+
+func Test_proxyProtocolListenerInvalid(t *testing.T) {
+	for name, header := range map[string][]byte{
+		"missing":     []byte("SSH-2.0-Go\r\n"),
+		"v1_bad_ip":   []byte("PROXY TCP4 ::1 192.0.2.2 56324 22\r\n"),
+		"v1_no_crlf":  append([]byte("PROXY TCP4 "), make([]byte, 120)...),
+		"v2_version":  append(append([]byte{}, proxyProtocolV2Signature...), 0x11, 0x11, 0, 0),
+		"v2_short":    proxyHeaderV2(0x1, 0x11, []byte{192, 0, 2, 1}),
+		"v2_truncate": append(append([]byte{}, proxyProtocolV2Signature...), 0x21, 0x11, 0, 12, 1),
+	} {
+		header := header
+		t.Run(name, func(t *testing.T) {
+			client, server := proxyProtocolPipe(t)
+			go func() {
+				_, _ = client.Write(header)
+				_ = client.(*net.TCPConn).CloseWrite()
+			}()
+			_, err := server.Read(make([]byte, 1))
+			if !errors.Is(err, ErrInvalidProxyHeader) {
+				t.Fatalf("expected ErrInvalidProxyHeader, got: %v", err)
+			}
+		})
+	}
+}
+
+func Test_proxyProtocolListenerSSH(t *testing.T) {
+	client, server := proxyProtocolPipe(t)
+
+	signer, err := generateSigner()
+	if err != nil {
+		t.Fatalf("generate signer: %v", err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 22\r\n"))
+		clientConn, _, _, err := ssh.NewClientConn(client, "localhost", testClientConfig())
+		if err == nil {
+			clientConn.Close()
+		}
+	}()
+
+	serverConn, _, _, err := ssh.NewServerConn(server, serverConfig)
+	if err != nil {
+		t.Fatalf("new server conn: %v", err)
+	}
+	defer serverConn.Close()
+	if remote := serverConn.RemoteAddr().String(); remote != "192.0.2.1:56324" {
+		t.Fatalf("unexpected remote address, got %s", remote)
+	}
+}
+
+// proxyProtocolPipe returns a client connection and the corresponding
+// connection accepted by a ProxyProtocolListener.
+func proxyProtocolPipe(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	client, server, err = netPipeWithDialer(net.Dial, func(string, string) (net.Listener, error) {
+		return &ProxyProtocolListener{Listener: l, ReadHeaderTimeout: 3 * time.Second}, nil
+	}, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("new net pipe: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
@@ -0,0 +1,85 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PtyRequest is the payload of a "pty-req" channel request,
+// as described in RFC 4254, section 6.2.
+type PtyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	// Modes holds the encoded terminal modes.
+	Modes string
+}
+
+// ParsePtyRequest decodes the payload of a "pty-req" request.
+func ParsePtyRequest(payload []byte) (PtyRequest, error) {
+	var req PtyRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return PtyRequest{}, fmt.Errorf("parse pty-req payload: %w", err)
+	}
+	return req, nil
+}
+
+// Marshal encodes the request as the payload of a "pty-req" request.
+func (p PtyRequest) Marshal() []byte {
+	return ssh.Marshal(p)
+}
+
+// windowChange is the payload of a "window-change" channel request,
+// as described in RFC 4254, section 6.7.
+type windowChange struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+const (
+	ptyRequestType    = "pty-req"
+	windowRequestType = "window-change"
+)
+
+// ptyRewrite returns a requestRewrite that applies PtyRewrite to "pty-req"
+// requests, and to the dimensions of "window-change" requests such that the
+// window size seen by the target stays consistent.
+func (r *ReverseProxy) ptyRewrite() requestRewrite {
+	if r.PtyRewrite == nil {
+		return nil
+	}
+	return func(ctx context.Context, req *ssh.Request) error {
+		switch req.Type {
+		case ptyRequestType:
+			pty, err := ParsePtyRequest(req.Payload)
+			if err != nil {
+				return nil
+			}
+			req.Payload = r.PtyRewrite(ctx, pty).Marshal()
+		case windowRequestType:
+			var change windowChange
+			if err := ssh.Unmarshal(req.Payload, &change); err != nil {
+				return nil
+			}
+			pty := r.PtyRewrite(ctx, PtyRequest{
+				Columns: change.Columns,
+				Rows:    change.Rows,
+				Width:   change.Width,
+				Height:  change.Height,
+			})
+			req.Payload = ssh.Marshal(windowChange{
+				Columns: pty.Columns,
+				Rows:    pty.Rows,
+				Width:   pty.Width,
+				Height:  pty.Height,
+			})
+		}
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+package sshproxy
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_parsePtyRequest(t *testing.T) {
+	req := PtyRequest{Term: "xterm", Columns: 80, Rows: 24, Width: 640, Height: 480, Modes: "\x00"}
+	parsed, err := ParsePtyRequest(req.Marshal())
+	if err != nil {
+		t.Fatalf("parse pty request: %v", err)
+	}
+	if parsed != req {
+		t.Fatalf("expected %+v, got %+v", req, parsed)
+	}
+	if _, err := ParsePtyRequest([]byte("invalid")); err == nil {
+		t.Fatalf("expected error parsing invalid payload")
+	}
+}
+
+func Test_ptyRewrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type request struct {
+		reqType string
+		payload []byte
+	}
+	received := make(chan request, 3)
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			defer ch.Close()
+			for req := range reqs {
+				received <- request{req.Type, req.Payload}
+				if req.WantReply {
+					_ = req.Reply(true, nil)
+				}
+			}
+		}
+	})
+
+	clamp := func(n uint32) uint32 {
+		if n > 500 {
+			return 500
+		}
+		return n
+	}
+	proxy := New(backendAddr, testClientConfig())
+	proxy.PtyRewrite = func(_ context.Context, req PtyRequest) PtyRequest {
+		if req.Term != "" {
+			req.Term = "xterm-256color"
+		}
+		req.Columns, req.Rows = clamp(req.Columns), clamp(req.Rows)
+		return req
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.RequestPty("vt100", 10000, 80, ssh.TerminalModes{ssh.ECHO: 0}); err != nil {
+		t.Fatalf("request pty: %v", err)
+	}
+	if err := session.WindowChange(40, 9000); err != nil {
+		t.Fatalf("window change: %v", err)
+	}
+	if err := session.Setenv("TERM", "vt100"); err != nil {
+		t.Fatalf("set env: %v", err)
+	}
+
+	pty := <-received
+	if pty.reqType != "pty-req" {
+		t.Fatalf("expected pty-req, got %s", pty.reqType)
+	}
+	ptyReq, err := ParsePtyRequest(pty.payload)
+	if err != nil {
+		t.Fatalf("parse pty request: %v", err)
+	}
+	if ptyReq.Term != "xterm-256color" || ptyReq.Columns != 80 || ptyReq.Rows != 500 || ptyReq.Modes == "" {
+		t.Fatalf("unexpected rewritten pty request: %+v", ptyReq)
+	}
+
+	window := <-received
+	var change windowChange
+	if err := ssh.Unmarshal(window.payload, &change); err != nil {
+		t.Fatalf("parse window change: %v", err)
+	}
+	if window.reqType != "window-change" || change.Columns != 500 || change.Rows != 40 {
+		t.Fatalf("unexpected rewritten window change: %s %+v", window.reqType, change)
+	}
+
+	env := <-received
+	var kv struct{ Key, Value string }
+	if err := ssh.Unmarshal(env.payload, &kv); err != nil || env.reqType != "env" || kv.Value != "vt100" {
+		t.Fatalf("expected env request to be untouched, got %s %+v", env.reqType, kv)
+	}
+}
@@ -0,0 +1,128 @@
+package sshproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// rateLimitBurstDivisor sets the capacity of each token bucket to a tenth of
+// a second of data, such that the occasional keystroke or small write is not
+// delayed, while larger transfers are smoothed into short bursts.
+const rateLimitBurstDivisor = 10
+
+// rateLimiter is a token bucket, refilled at rate bytes per second up to
+// burst bytes. Reservations may drive the bucket negative, queueing later
+// writers behind earlier ones.
+type rateLimiter struct {
+	clock clock
+	rate  int64
+	burst int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(clk clock, rate int64) *rateLimiter {
+	burst := rate / rateLimitBurstDivisor
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{clock: clk, rate: rate, burst: burst, tokens: float64(burst), last: clk.Now()}
+}
+
+// wait blocks until n bytes, at most burst, may be written, or until ctx is
+// done, returning its error.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := l.clock.NewTimer(time.Duration(deficit / float64(l.rate) * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// rateLimitedWriter splits writes into chunks of at most the
+// limiter's burst, waiting for each to be permitted until ctx is done.
+type rateLimitedWriter struct {
+	io.Writer
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (w rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > w.limiter.burst {
+			chunk = chunk[:w.limiter.burst]
+		}
+		if err := w.limiter.wait(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.Writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// rateLimitedChannel limits the rate of data written to the wrapped
+// ssh.Channel, including its stderr stream, until ctx is done.
+type rateLimitedChannel struct {
+	ssh.Channel
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (c rateLimitedChannel) Write(p []byte) (int, error) {
+	return rateLimitedWriter{c.Channel, c.ctx, c.limiter}.Write(p)
+}
+
+func (c rateLimitedChannel) Stderr() io.ReadWriter {
+	stderr := c.Channel.Stderr()
+	return struct {
+		io.Reader
+		io.Writer
+	}{stderr, rateLimitedWriter{stderr, c.ctx, c.limiter}}
+}
+
+// rateLimitChannels wraps both channels of a proxied channel according to
+// RateLimitBytesPerSec and RateLimitCombined, if set, such that throttled
+// writes are abandoned once ctx is done.
+func (c *proxyConn) rateLimitChannels(ctx context.Context, origin, dest ssh.Channel) (ssh.Channel, ssh.Channel) {
+	rate := c.proxy.RateLimitBytesPerSec
+	if rate <= 0 {
+		return origin, dest
+	}
+	clk := c.proxy.clock()
+	originLimiter := newRateLimiter(clk, rate)
+	destLimiter := originLimiter
+	if !c.proxy.RateLimitCombined {
+		destLimiter = newRateLimiter(clk, rate)
+	}
+	return rateLimitedChannel{origin, ctx, originLimiter}, rateLimitedChannel{dest, ctx, destLimiter}
+}
@@ -0,0 +1,113 @@
+package sshproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func Test_rateLimit(t *testing.T) {
+	const rate = 100 * 1024
+	const size = 50 * 1024
+	burst := time.Duration(rate/rateLimitBurstDivisor) * time.Second / rate
+
+	for _, combined := range []bool{false, true} {
+		name := "per_direction"
+		// the input is echoed, so each direction transfers size bytes
+		transferred := size
+		if combined {
+			name = "combined"
+			transferred = 2 * size
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+			proxy.RateLimitBytesPerSec = rate
+			proxy.RateLimitCombined = combined
+			client, _ := newProxiedClient(t, ctx, proxy)
+
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatalf("new ssh session: %v", err)
+			}
+			defer session.Close()
+			input := bytes.Repeat([]byte("a"), size)
+			session.Stdin = bytes.NewReader(input)
+
+			start := time.Now()
+			output, err := session.Output("cat")
+			if err != nil {
+				t.Fatalf("execute command: %v", err)
+			}
+			elapsed := time.Since(start)
+			if !bytes.Equal(output, input) {
+				t.Fatalf("expected %d bytes echoed, got %d", size, len(output))
+			}
+			expected := time.Duration(transferred)*time.Second/rate - burst
+			if elapsed < expected {
+				t.Fatalf("expected transfer to take at least %v, took %v", expected, elapsed)
+			}
+		})
+	}
+}
+
+func Test_rateLimitSmallWrites(t *testing.T) {
+	limiter := newRateLimiter(realClock{}, 1024)
+	w := rateLimitedWriter{io.Discard, context.Background(), limiter}
+
+	// writes within the burst are not delayed
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := w.Write([]byte("keystroke")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected small writes not to be delayed, took %v", elapsed)
+	}
+}
+
+func Test_rateLimitChunks(t *testing.T) {
+	limiter := newRateLimiter(realClock{}, 1000)
+	var buf bytes.Buffer
+	w := rateLimitedWriter{&buf, context.Background(), limiter}
+
+	// 300 bytes exceed the 100 byte burst by 200 bytes, taking 200ms
+	start := time.Now()
+	n, err := w.Write(bytes.Repeat([]byte("a"), 300))
+	if err != nil || n != 300 || buf.Len() != 300 {
+		t.Fatalf("expected 300 bytes written, got %d and %d: %v", n, buf.Len(), err)
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("expected write to be limited, took %v", elapsed)
+	}
+}
+
+func Test_rateLimitCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	limiter := newRateLimiter(realClock{}, 100)
+	w := rateLimitedWriter{io.Discard, ctx, limiter}
+
+	// writing 200 bytes at 100 bytes per second takes two seconds, unless
+	// the write is abandoned
+	result := make(chan error, 1)
+	go func() {
+		_, err := w.Write(bytes.Repeat([]byte("a"), 200))
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("expected throttled write to return once canceled")
+	}
+}
@@ -0,0 +1,160 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrReAuthFailed is returned by Serve when the client fails to answer
+// a periodic re-authentication challenge in time.
+var ErrReAuthFailed = errors.New("sshproxy: re-authentication failed")
+
+const (
+	shellRequestType = "shell"
+
+	// defaultReAuthTimeout is used when ReAuthTimeout is zero.
+	defaultReAuthTimeout = time.Minute
+
+	reAuthPrompt = "\r\nsshproxy: re-authentication required: "
+)
+
+// reAuth periodically challenges the client over a shell session channel.
+// While a challenge is pending, input from the client is consumed as the
+// answer rather than relayed to the target.
+type reAuth struct {
+	conn *proxyConn
+	ch   ssh.Channel
+
+	mu      sync.Mutex
+	shell   bool
+	pending bool
+	answer  []byte
+	result  chan bool
+}
+
+// newReAuth returns a reAuth for the client session channel ch, or nil if
+// ReAuthInterval or ReAuthVerify is unset. Challenges are issued until the
+// context is cancelled.
+func (c *proxyConn) newReAuth(ctx context.Context, ch ssh.Channel) *reAuth {
+	if c.proxy.ReAuthInterval <= 0 || c.proxy.ReAuthVerify == nil {
+		return nil
+	}
+	a := &reAuth{conn: c, ch: ch, result: make(chan bool, 1)}
+	go a.run(ctx)
+	return a
+}
+
+// run issues a challenge every ReAuthInterval once a shell has been
+// requested, failing the connection if a challenge is not answered
+// correctly within ReAuthTimeout.
+func (a *reAuth) run(ctx context.Context) {
+	timeout := a.conn.proxy.ReAuthTimeout
+	if timeout <= 0 {
+		timeout = defaultReAuthTimeout
+	}
+	clk := a.conn.proxy.clock()
+	ticker := clk.NewTicker(a.conn.proxy.ReAuthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		a.mu.Lock()
+		challenge := a.shell
+		a.pending, a.answer = challenge, nil
+		a.mu.Unlock()
+		if !challenge {
+			continue
+		}
+		if _, err := a.ch.Write([]byte(reAuthPrompt)); err != nil {
+			return
+		}
+
+		timer := clk.NewTimer(timeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case ok := <-a.result:
+			timer.Stop()
+			if ok {
+				continue
+			}
+		case <-timer.C():
+		}
+		a.conn.logger.Warn("sshproxy: ReverseProxy %v", ErrReAuthFailed)
+		a.conn.fail(ErrReAuthFailed)
+		return
+	}
+}
+
+// rewrite returns a requestRewrite that records whether a shell has been
+// requested, such that only shell sessions are challenged.
+func (a *reAuth) rewrite() requestRewrite {
+	if a == nil {
+		return nil
+	}
+	return func(_ context.Context, req *ssh.Request) error {
+		if req.Type == shellRequestType {
+			a.mu.Lock()
+			a.shell = true
+			a.mu.Unlock()
+		}
+		return nil
+	}
+}
+
+// consume handles input from the client, returning the bytes to relay to
+// the target. Input received while a challenge is pending is consumed as the
+// answer up to the end of the line, which is not echoed.
+func (a *reAuth) consume(p []byte) []byte {
+	a.mu.Lock()
+	if !a.pending {
+		a.mu.Unlock()
+		return p
+	}
+	for i, b := range p {
+		switch b {
+		case '\r', '\n':
+			answer := string(a.answer)
+			a.pending, a.answer = false, nil
+			a.mu.Unlock()
+
+			_, _ = a.ch.Write([]byte("\r\n"))
+			a.result <- a.conn.proxy.ReAuthVerify(a.conn.client, answer)
+			return p[i+1:]
+		case 0x7f, '\b':
+			if len(a.answer) > 0 {
+				a.answer = a.answer[:len(a.answer)-1]
+			}
+		default:
+			a.answer = append(a.answer, b)
+		}
+	}
+	a.mu.Unlock()
+	return nil
+}
+
+// reAuthChannel is a client channel whose input is consumed
+// by a pending re-authentication challenge.
+type reAuthChannel struct {
+	ssh.Channel
+	reAuth *reAuth
+}
+
+func (c reAuthChannel) Read(p []byte) (int, error) {
+	for {
+		n, err := c.Channel.Read(p)
+		relay := c.reAuth.consume(p[:n])
+		if len(relay) > 0 || err != nil {
+			return copy(p, relay), err
+		}
+	}
+}
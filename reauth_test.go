@@ -0,0 +1,118 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveEchoShell serves sessions whose shell echoes its input.
+func serveEchoShell(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				_ = req.Reply(req.Type == shellRequestType, nil)
+				if req.Type == shellRequestType {
+					go ssh.DiscardRequests(reqs)
+					_, _ = io.Copy(ch, ch)
+					return
+				}
+			}
+		}()
+	}
+}
+
+// startReAuthShell starts a shell through a proxy challenging every
+// interval, returning its stdin and output once the first prompt appears.
+func startReAuthShell(t *testing.T, ctx context.Context, proxy *ReverseProxy) (io.Writer, *lockedBuffer, <-chan error) {
+	t.Helper()
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("stdin pipe: %v", err)
+	}
+	var stdout lockedBuffer
+	session.Stdout = &stdout
+	if err := session.Shell(); err != nil {
+		t.Fatalf("start shell: %v", err)
+	}
+	waitForOutput(t, &stdout, reAuthPrompt)
+	return stdin, &stdout, serveErr
+}
+
+func waitForOutput(t *testing.T, output *lockedBuffer, expected string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !strings.Contains(output.String(), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected output to contain %q, got %q", expected, output.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_reAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveEchoShell), testClientConfig())
+	proxy.ReAuthInterval = 50 * time.Millisecond
+	proxy.ReAuthVerify = func(conn ssh.ConnMetadata, answer string) bool {
+		return conn.User() == "test" && answer == "secret"
+	}
+	stdin, stdout, _ := startReAuthShell(t, ctx, proxy)
+
+	// the answer is not relayed to the target
+	if _, err := io.WriteString(stdin, "secret\rhello"); err != nil {
+		t.Fatalf("write stdin: %v", err)
+	}
+	waitForOutput(t, stdout, "hello")
+	if strings.Contains(stdout.String(), "secret") {
+		t.Fatalf("expected answer not to be relayed, got %q", stdout.String())
+	}
+}
+
+func Test_reAuthFailed(t *testing.T) {
+	for name, answer := range map[string]string{"rejected": "wrong\r", "timeout": ""} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			proxy := New(newTestBackend(t, serveEchoShell), testClientConfig())
+			proxy.ReAuthInterval = 50 * time.Millisecond
+			proxy.ReAuthTimeout = 100 * time.Millisecond
+			proxy.ReAuthVerify = func(conn ssh.ConnMetadata, answer string) bool {
+				return answer == "secret"
+			}
+			stdin, _, serveErr := startReAuthShell(t, ctx, proxy)
+			if _, err := io.WriteString(stdin, answer); err != nil {
+				t.Fatalf("write stdin: %v", err)
+			}
+
+			select {
+			case err := <-serveErr:
+				if !errors.Is(err, ErrReAuthFailed) {
+					t.Fatalf("expected ErrReAuthFailed, got: %v", err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatalf("expected reverse proxy to return after failed re-authentication")
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package sshproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Recorder provides the destinations for recordings of proxied "session"
+// channels. Each recording is written in the asciicast v2 format, with
+// client input as "i" events, target output (including stderr) as "o"
+// events, and "exec", "shell", and "subsystem" requests as "m" marker
+// events, all timestamped relative to the start of the channel. The header
+// takes the terminal size of a "pty-req" sent before the first event,
+// defaulting to 80x24, and later size changes are recorded as "r" events.
+type Recorder interface {
+	// Record returns the writer to which a new session channel of the given
+	// connection is recorded. The writer is closed once the channel has
+	// closed. If the returned writer is nil, the channel is not recorded.
+	// If an error is returned, the channel is rejected.
+	Record(conn ssh.ConnMetadata) (io.WriteCloser, error)
+}
+
+// recording writes timestamped asciicast events to an underlying writer.
+// It is safe for concurrent use.
+type recording struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	clock  clock
+	start  time.Time
+	logger LeveledLogger
+	// the header is written before the first event, such that it takes
+	// the terminal size of a preceding "pty-req"
+	header        bool
+	width, height uint32
+	streams       []*eventStream
+}
+
+func newRecording(w io.WriteCloser, logger LeveledLogger, clk clock) *recording {
+	return &recording{w: w, clock: clk, start: clk.Now(), logger: logger, width: 80, height: 24}
+}
+
+// writeHeader writes the header if it has not yet been written. r.mu must be held.
+func (r *recording) writeHeader() {
+	if r.header {
+		return
+	}
+	r.header = true
+	header, _ := json.Marshal(map[string]any{
+		"version":   2,
+		"width":     r.width,
+		"height":    r.height,
+		"timestamp": r.start.Unix(),
+	})
+	r.writeLine(header)
+}
+
+// event records data with the given asciicast event code.
+func (r *recording) event(code string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeEvent(code, data)
+}
+
+// writeEvent writes an event, preceded by the header if needed. r.mu must be held.
+func (r *recording) writeEvent(code string, data []byte) {
+	r.writeHeader()
+	// timestamp under the lock so that events are written in order
+	line, _ := json.Marshal([]any{r.clock.Now().Sub(r.start).Seconds(), code, string(data)})
+	r.writeLine(line)
+}
+
+// resize records a change of the terminal size. Before the header has
+// been written, the size is taken for the header instead.
+func (r *recording) resize(columns, rows uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.header {
+		r.width, r.height = columns, rows
+		return
+	}
+	r.writeEvent("r", []byte(fmt.Sprintf("%dx%d", columns, rows)))
+}
+
+// writeLine writes a newline-terminated line. r.mu must be held
+// once the recording is shared.
+func (r *recording) writeLine(line []byte) {
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		r.logger.Error("sshproxy: write session recording: %v", err)
+	}
+}
+
+// stream returns a new eventStream recording data with the given event code.
+func (r *recording) stream(code string) *eventStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := &eventStream{rec: r, code: code}
+	r.streams = append(r.streams, s)
+	return s
+}
+
+func (r *recording) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// flush any incomplete UTF-8 sequences left at the end of a stream
+	for _, s := range r.streams {
+		if len(s.pending) > 0 {
+			r.writeEvent(s.code, s.pending)
+			s.pending = nil
+		}
+	}
+	r.writeHeader()
+	if err := r.w.Close(); err != nil {
+		r.logger.Error("sshproxy: close session recording: %v", err)
+	}
+}
+
+// eventStream records the data of a single stream. As events are JSON
+// strings, an incomplete UTF-8 sequence at the end of the data is held back
+// until the rest of it has been read, rather than split across two events.
+type eventStream struct {
+	rec     *recording
+	code    string
+	pending []byte
+}
+
+func (s *eventStream) write(data []byte) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+	data = append(s.pending, data...)
+	n := completeUTF8(data)
+	s.pending = append([]byte(nil), data[n:]...)
+	if n > 0 {
+		s.rec.writeEvent(s.code, data[:n])
+	}
+}
+
+// completeUTF8 returns the length of data without an incomplete UTF-8
+// sequence at its end.
+func completeUTF8(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+// recordedChannel records all data read from the wrapped ssh.Channel with
+// the given event code, along with any commands and terminal sizes sent as
+// requests.
+type recordedChannel struct {
+	ssh.Channel
+	rec            *recording
+	stdout, stderr *eventStream
+}
+
+func newRecordedChannel(ch ssh.Channel, rec *recording, code string) recordedChannel {
+	return recordedChannel{ch, rec, rec.stream(code), rec.stream(code)}
+}
+
+func (c recordedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.stdout.write(p[:n])
+	}
+	return n, err
+}
+
+func (c recordedChannel) Stderr() io.ReadWriter {
+	return recordedStream{c.Channel.Stderr(), c.stderr}
+}
+
+func (c recordedChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	switch name {
+	case "shell":
+		c.rec.event("m", []byte(name))
+	case "exec", "subsystem":
+		var msg struct{ Value string }
+		if err := ssh.Unmarshal(payload, &msg); err == nil {
+			c.rec.event("m", []byte(fmt.Sprintf("%s: %s", name, msg.Value)))
+		}
+	case ptyRequestType:
+		if req, err := ParsePtyRequest(payload); err == nil {
+			c.rec.resize(req.Columns, req.Rows)
+		}
+	case windowRequestType:
+		var msg windowChange
+		if err := ssh.Unmarshal(payload, &msg); err == nil {
+			c.rec.resize(msg.Columns, msg.Rows)
+		}
+	}
+	return c.Channel.SendRequest(name, wantReply, payload)
+}
+
+// recordedStream records all data read from the wrapped stream.
+type recordedStream struct {
+	io.ReadWriter
+	stream *eventStream
+}
+
+func (s recordedStream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriter.Read(p)
+	if n > 0 {
+		s.stream.write(p[:n])
+	}
+	return n, err
+}
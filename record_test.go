@@ -0,0 +1,120 @@
+package sshproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type bufferRecorder struct {
+	buf    bytes.Buffer
+	closed chan struct{}
+}
+
+func (b *bufferRecorder) Record(conn ssh.ConnMetadata) (io.WriteCloser, error) {
+	return b, nil
+}
+
+func (b *bufferRecorder) Write(p []byte) (int, error) { return b.buf.Write(p) }
+
+func (b *bufferRecorder) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func Test_recorder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recorder := &bufferRecorder{closed: make(chan struct{})}
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.Recorder = recorder
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testStdin(t, client)
+	<-recorder.closed
+
+	scanner := bufio.NewScanner(&recorder.buf)
+	if !scanner.Scan() {
+		t.Fatalf("expected recording header")
+	}
+	var header struct{ Version int }
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+		t.Fatalf("unexpected recording header %q: %v", scanner.Text(), err)
+	}
+
+	var events []string
+	var last float64
+	for scanner.Scan() {
+		var event [3]any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("unmarshal event %q: %v", scanner.Text(), err)
+		}
+		elapsed := event[0].(float64)
+		if elapsed < last {
+			t.Fatalf("expected increasing event timestamps, got %v after %v", elapsed, last)
+		}
+		last = elapsed
+		events = append(events, event[1].(string)+" "+event[2].(string))
+	}
+
+	expected := []string{"m exec: cat", "i testing\n", "o testing\n"}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected events, expected %q, got %q", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("unexpected events, expected %q, got %q", expected, events)
+		}
+	}
+}
+
+func Test_recordingTerminal(t *testing.T) {
+	recorder := &bufferRecorder{closed: make(chan struct{})}
+	rec := newRecording(recorder, printfLogger{}, realClock{})
+	out := rec.stream("o")
+
+	rec.resize(120, 40)
+	rec.event("m", []byte("shell"))
+	rec.resize(100, 30)
+	// "€" is split across reads
+	euro := []byte("€")
+	out.write(append([]byte("a"), euro[:1]...))
+	out.write(euro[1:2])
+	out.write(append(euro[2:], 'b'))
+	rec.close()
+
+	scanner := bufio.NewScanner(&recorder.buf)
+	if !scanner.Scan() {
+		t.Fatalf("expected recording header")
+	}
+	var header struct{ Width, Height int }
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatalf("unmarshal header %q: %v", scanner.Text(), err)
+	}
+	if header.Width != 120 || header.Height != 40 {
+		t.Fatalf("expected header size from pty-req, got %dx%d", header.Width, header.Height)
+	}
+
+	var events []string
+	for scanner.Scan() {
+		var event [3]any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("unmarshal event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event[1].(string)+" "+event[2].(string))
+	}
+	expected := []string{"m shell", "r 100x30", "o a", "o €b"}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected events, expected %q, got %q", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("unexpected events, expected %q, got %q", expected, events)
+		}
+	}
+}
@@ -7,6 +7,11 @@ import (
 	"io"
 	"log"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -17,100 +22,1159 @@ type ReverseProxy struct {
 	TargetAddress      string
 	TargetClientConfig *ssh.ClientConfig
 
+	// TargetResolver optionally resolves the target address and client config
+	// for each call to Serve, taking precedence over TargetAddress and
+	// TargetClientConfig. It is called before dialing the target. As the
+	// server connection has completed authentication, its User and
+	// Permissions are populated, such that the authentication callbacks of
+	// the ssh.ServerConfig may pass routing hints through
+	// Permissions.Extensions.
+	TargetResolver func(ctx context.Context, serverConn *ssh.ServerConn) (addr string, config *ssh.ClientConfig, err error)
+
+	// Network specifies the network used to dial TargetAddress.
+	// If empty, "tcp" is used.
+	Network string
+
+	// Dial specifies an optional dial function for creating the connection
+	// to the target. If nil, a net.Dialer is used with a timeout of
+	// DialTimeout, or else TargetClientConfig.Timeout.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	// ErrorLog specifies an optional logger for errors
 	// that occur when attempting to proxy.
 	// If nil, logging is done via the log package's standard logger.
+	// Messages below LogLevel are discarded.
 	ErrorLog *log.Logger
+
+	// Logger optionally specifies a leveled logger, taking precedence
+	// over ErrorLog and LogLevel.
+	Logger LeveledLogger
+
+	// LogLevel specifies the minimum level of messages written to ErrorLog
+	// or the standard logger. The zero value is LevelInfo, such that debug
+	// messages are discarded.
+	LogLevel LogLevel
+
+	// Hooks specifies optional callbacks for observing
+	// the lifecycle of proxied channels and requests.
+	Hooks *Hooks
+
+	// KeepAlive specifies the interval at which keepalive requests are sent
+	// to the target. If the target does not reply within the interval, Serve
+	// returns ErrKeepAliveTimeout. If zero, no keepalives are sent.
+	KeepAlive time.Duration
+
+	// ChannelFilter optionally reports whether a channel opened by the client
+	// should be proxied. If it returns false, the channel is rejected with
+	// ssh.Prohibited without being opened on the target. Like the other
+	// filters, rewrites and Hooks, it is given a context derived from the one
+	// passed to Serve, from which PermissionsFromContext returns the client's
+	// permissions.
+	ChannelFilter func(ctx context.Context, channelType string, extraData []byte) bool
+
+	// TargetChannelFilter optionally reports whether a channel opened by the
+	// target toward the client, such as for remote port forwarding, should
+	// be proxied. If it returns false, the channel is rejected with
+	// ssh.Prohibited without being opened on the client. Agent channels are
+	// also rejected if DisableAgentForwarding is set.
+	TargetChannelFilter func(ctx context.Context, channelType string, extraData []byte) bool
+
+	// InspectChannel is optionally called with the unmodified type and extra
+	// data of every channel, whether opened by the client or the target,
+	// before any other filtering. If it returns an error, the channel is
+	// rejected with ssh.Prohibited and the error's text as the message,
+	// without being opened on the other side. The extra data must not be
+	// modified.
+	InspectChannel func(ctx context.Context, channelType string, extraData []byte) error
+
+	// RequestFilter optionally reports whether a channel-level request sent by
+	// the client, such as "x11-req" or "auth-agent-req@openssh.com", should be
+	// relayed to the target. Rejected requests are replied to with failure if
+	// the client wants a reply.
+	RequestFilter func(ctx context.Context, reqType string, payload []byte) bool
+
+	// GlobalRequestFilter is like RequestFilter, but for connection-level
+	// requests sent by the client, such as "tcpip-forward".
+	GlobalRequestFilter func(ctx context.Context, reqType string, payload []byte) bool
+
+	// DisableAgentForwarding specifies whether to prevent the client from
+	// forwarding its SSH agent to the target. If true,
+	// "auth-agent-req@openssh.com" requests sent by the client and the
+	// "auth-agent@openssh.com" channels opened by the target are rejected.
+	// By default, both are relayed.
+	DisableAgentForwarding bool
+
+	// Recorder optionally records the data and commands
+	// of "session" channels opened by the client.
+	Recorder Recorder
+
+	// Events optionally receives structured events for the lifecycle of each
+	// proxied connection, in addition to the human-readable ErrorLog.
+	Events EventLogger
+
+	// BufferPool optionally specifies a buffer pool to get byte slices
+	// for use by io.CopyBuffer when copying channel data.
+	BufferPool BufferPool
+
+	// BufferSize specifies the size of the pooled buffers used to copy
+	// channel data when BufferPool is nil. If zero, 32KB is used.
+	BufferSize int
+
+	// NoStderrChannelTypes specifies the channel types whose extended data
+	// (stderr) stream is not copied, saving a goroutine per channel. If nil,
+	// forwarding, X11, and agent channels, which carry no stderr, are
+	// skipped. Set it to an empty slice to copy stderr for every channel
+	// type. Extended data sent on a skipped channel is never read, such that
+	// a peer sending it anyway eventually exhausts the channel window.
+	NoStderrChannelTypes []string
+
+	// HalfCloseGrace specifies how long to wait for data still being sent by
+	// the side that opened a channel, such as the client's final input to a
+	// session, once the opposite direction has finished. If zero, the channel
+	// may be closed without waiting for it.
+	HalfCloseGrace time.Duration
+
+	// DialAttempts specifies the maximum number of attempts made to dial the
+	// target and establish the SSH connection, retrying connection failures
+	// but not authentication or host key verification failures. Values less
+	// than one mean one attempt.
+	DialAttempts int
+
+	// DialBackoff specifies the delay before the second attempt, which is
+	// doubled for each subsequent attempt.
+	DialBackoff time.Duration
+
+	// OnConnect is optionally called once the target has been dialed.
+	OnConnect func(info ConnInfo)
+
+	// OnDisconnect is optionally called exactly once when Serve returns after
+	// OnConnect has been called, including when the SSH handshake with the
+	// target fails, with the error returned by Serve.
+	OnDisconnect func(info ConnInfo, err error)
+
+	// WriteTimeout specifies the maximum duration of a single write of channel
+	// data, such as toward a client that has stopped reading. If a write does
+	// not complete in time, the channel is closed in both directions. If zero,
+	// there is no timeout.
+	WriteTimeout time.Duration
+
+	// IdleTimeout specifies the maximum duration for which no channel data
+	// may flow in either direction before both connections are closed and
+	// Serve returns ErrIdleTimeout. If zero, there is no idle timeout.
+	IdleTimeout time.Duration
+
+	// MaxInFlightBytes optionally limits the number of bytes of channel data
+	// read from either side of a connection but not yet written to the other,
+	// across all of its channels. Bytes are counted once a read returns, such
+	// that channels blocked on idle streams hold none of the limit. Once the
+	// limit is reached, each copy holds what it has read, up to one buffer,
+	// until pending writes complete, and makes no further reads, such that
+	// the ssh package stops extending the sender's channel window. The ssh
+	// package does not allow configuring the window or packet sizes, so each
+	// channel may still buffer up to its window internally, which
+	// MaxChannelsPerConn bounds in turn. If zero, each copy in flight holds
+	// up to one buffer of BufferSize bytes.
+	MaxInFlightBytes int64
+
+	// RateLimitBytesPerSec optionally limits the throughput of each proxied
+	// channel, in bytes per second in each direction. Writes smaller than a
+	// tenth of a second of data, such as keystrokes, are not delayed unless
+	// the limit has been reached. If zero, throughput is not limited.
+	RateLimitBytesPerSec int64
+
+	// RateLimitCombined applies RateLimitBytesPerSec to the sum of both
+	// directions of each channel, rather than to each direction.
+	RateLimitCombined bool
+
+	// DialClient optionally establishes the SSH connection to the target,
+	// such as by returning a connection from a pool, in place of dialing
+	// TargetAddress and performing the handshake with TargetClientConfig.
+	// Dial and DialAttempts are ignored when it is set.
+	//
+	// Serve takes ownership of the returned connection: it consumes the
+	// returned channels until they are closed or Serve returns, and closes
+	// the connection, possibly more than once, by the time it returns. To
+	// share an underlying connection between clients, return an ssh.Conn
+	// whose Close releases it rather than closing it, as SharedBackend does.
+	DialClient func(ctx context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error)
+
+	// Metrics optionally receives measurements of proxied connections
+	// and channels.
+	Metrics Metrics
+
+	// MaxSessionDuration specifies the maximum duration of a proxied
+	// connection, regardless of activity, after which both connections are
+	// closed and Serve returns ErrMaxSessionDuration. If zero, there is no
+	// limit.
+	MaxSessionDuration time.Duration
+
+	// PtyRewrite optionally modifies the "pty-req" requests sent by the
+	// client before they are relayed to the target, such as to override the
+	// terminal type or clamp the window size. It is also called with the
+	// dimensions of "window-change" requests, with Term and Modes unset, so
+	// that a rewritten window size remains consistent.
+	PtyRewrite func(ctx context.Context, req PtyRequest) PtyRequest
+
+	// OnExit is optionally called when the target reports how a command
+	// exited with an "exit-status" or "exit-signal" request, before the
+	// request is relayed to the client.
+	OnExit func(ctx context.Context, channelType string, status ExitInfo)
+
+	// ExitRewrite optionally modifies the exit reported to the client, such
+	// as to remap exit statuses. The kind of the request is preserved: only
+	// Status applies to "exit-status" requests, and only the signal fields
+	// to "exit-signal" requests.
+	ExitRewrite func(ctx context.Context, channelType string, status ExitInfo) ExitInfo
+
+	// InjectEnv optionally specifies environment variables to set in each
+	// session opened by the client. They are sent to the target as "env"
+	// requests before any request from the client, such that the client may
+	// override them. Variables rejected by the target are logged and skipped.
+	InjectEnv map[string]string
+
+	// DialTimeout specifies the maximum duration of each attempt to dial the
+	// target, including with Dial, separately from the SSH handshake that
+	// follows. If zero, the default dialer uses TargetClientConfig.Timeout.
+	DialTimeout time.Duration
+
+	// ClientVersionFilter optionally rejects clients by the version string
+	// sent during the handshake, such as to refuse a vulnerable client. If
+	// it returns an error, the client connection is closed without dialing
+	// the target, and Serve returns the error.
+	ClientVersionFilter func(ctx context.Context, version string) error
+
+	// ForwardFilter optionally reports whether a client may open a
+	// "direct-tcpip" channel, used for local port forwarding, to the given
+	// destination. Disallowed and malformed forwards are rejected with
+	// ssh.Prohibited. When set, "direct-streamlocal@openssh.com" channels,
+	// used to forward to Unix sockets on the target, are rejected as well.
+	// See CIDRForwardFilter.
+	ForwardFilter func(ctx context.Context, destHost string, destPort uint32) bool
+
+	// RemoteForwardFilter optionally reports whether a client may request
+	// remote port forwarding from the target with a "tcpip-forward" global
+	// request for the given bind address and port, where port 0 requests
+	// that the target allocate a port. Disallowed and malformed requests
+	// are rejected. The port allocated by the target is relayed to the
+	// client in the reply. Granted forwards are available to callbacks
+	// through RemoteForwardsFromContext.
+	RemoteForwardFilter func(ctx context.Context, bindAddr string, bindPort uint32) bool
+
+	// PreferredCiphers, PreferredMACs, and PreferredKeyExchanges optionally
+	// specify the algorithms allowed for the connection to the target, in
+	// order of preference, overriding those of the target client config.
+	// As the proxy terminates SSH on both hops, algorithms are negotiated
+	// independently for each. Use ApplyAlgorithms to apply the same
+	// preferences to the ssh.ServerConfig that accepts clients. Compression
+	// is not supported by golang.org/x/crypto/ssh on either hop.
+	PreferredCiphers      []string
+	PreferredMACs         []string
+	PreferredKeyExchanges []string
+
+	// MaxChannelsPerConn optionally limits the number of concurrently open
+	// channels of a connection, in either direction. Channels opened beyond
+	// the limit are rejected with ssh.ResourceShortage. If zero, there is no
+	// limit.
+	MaxChannelsPerConn int
+
+	// Authorizer optionally approves each authenticated client connection,
+	// such as by consulting an external authorization service, before the
+	// target is resolved and dialed. If it returns an error, the client
+	// connection is closed and Serve returns the error.
+	Authorizer func(ctx context.Context, conn *ssh.ServerConn) error
+
+	// ClientAddrEnv optionally names an environment variable, such as
+	// "SSH_PROXY_CLIENT_ADDR", set to the client's remote address in each
+	// session opened by the client, like InjectEnv. As the proxy dials the
+	// target itself, the target otherwise only sees the proxy's address.
+	// This requires the cooperation of the target, such as an OpenSSH
+	// AcceptEnv directive for the variable.
+	ClientAddrEnv string
+
+	// StripHostKeyExtensions, if true, drops the OpenSSH host key rotation
+	// extensions, "hostkeys-00@openssh.com" sent by the target and
+	// "hostkeys-prove-00@openssh.com" sent by the client, rather than
+	// relaying them. As the client authenticates the proxy's host key rather
+	// than the target's, relaying them could lead the client to trust the
+	// target's host keys for the proxy's address.
+	StripHostKeyExtensions bool
+
+	// SubsystemFilter optionally reports whether a "subsystem" request sent
+	// by the client for the named subsystem, such as "sftp", should be
+	// relayed to the target. Rejected requests are replied to with failure,
+	// like those rejected by RequestFilter.
+	SubsystemFilter func(ctx context.Context, name string) bool
+
+	// SignalFilter optionally reports whether a "signal" request sent by the
+	// client, such as when the user presses Ctrl-C, should be relayed to the
+	// target. The signal is named without the "SIG" prefix, such as "INT" or
+	// "KILL". Blocked signals are logged and replied to with failure.
+	SignalFilter func(ctx context.Context, sig string) bool
+
+	// CommandRewrite optionally rewrites the command of each "exec" request
+	// sent by the client before it is relayed to the target, such as to wrap
+	// it with a logging command. If it returns an error, the request is
+	// rejected, replying with failure if the client wants a reply. It is
+	// given the client's command even if a "force-command" is enforced by
+	// EnforceCertOptions, which then replaces the rewritten command.
+	CommandRewrite func(ctx context.Context, cmd string) (string, error)
+
+	// OnWeakHostKey is optionally called when the target at addr presents a
+	// host key using a deprecated algorithm, such as DSA or RSA shorter than
+	// 2048 bits, before the target's config verifies it. The connection
+	// proceeds if the key is accepted. The ssh package does not report the
+	// negotiated signature algorithm, so RSA keys signing with SHA-1
+	// ("ssh-rsa") are not detected.
+	OnWeakHostKey func(algo string, addr string)
+
+	// ReAuthInterval optionally specifies the interval at which clients are
+	// challenged to re-authenticate over each session channel running a
+	// shell, as SSH does not support re-authentication within a session.
+	// While a challenge is pending, a prompt is written to the session
+	// and the client's input up to the end of the line is passed to
+	// ReAuthVerify rather than relayed to the target. If the answer is
+	// rejected or not received within ReAuthTimeout, the connection is closed
+	// and Serve returns ErrReAuthFailed. This is best-effort: the prompt is
+	// interleaved with the target's output, and the terminal modes of the
+	// session, such as echo, are not changed. Both ReAuthInterval and
+	// ReAuthVerify must be set to enable challenges.
+	ReAuthInterval time.Duration
+
+	// ReAuthTimeout specifies how long the client has to answer a challenge.
+	// If zero, one minute is used.
+	ReAuthTimeout time.Duration
+
+	// ReAuthVerify reports whether the answer to a re-authentication
+	// challenge, such as a one-time password, is valid for the client.
+	ReAuthVerify func(conn ssh.ConnMetadata, answer string) bool
+
+	// EnforceCertOptions specifies whether to enforce the "source-address"
+	// and "force-command" critical options of the certificate with which the
+	// client authenticated, as returned in ssh.Permissions.CriticalOptions by
+	// an ssh.CertChecker supporting them. Note that sshutil.UserCertCallback
+	// rejects certificates with "force-command". Clients whose address is
+	// not allowed by "source-address" are rejected before the target is
+	// dialed. The "exec", "shell", and "subsystem" requests of clients with
+	// "force-command" are relayed as an "exec" request of the forced
+	// command. The original command is not passed to the target.
+	EnforceCertOptions bool
+
+	// ConnDeadline optionally specifies the maximum duration for which the
+	// connection to the target may go without receiving data, or may block
+	// while sending data. If it is exceeded, both connections are closed and
+	// Serve returns ErrConnDeadline. Unlike IdleTimeout, any traffic
+	// including keepalives counts, such that with a KeepAlive interval
+	// shorter than ConnDeadline, only unresponsive targets are torn down,
+	// rather than idle sessions. It applies to connections dialed by the
+	// proxy, but not to those returned by DialClient or to the client
+	// connection, which is established before Serve is called. For dialed
+	// connections that do not support deadlines, such as those returned by
+	// JumpDialer, only the time without receiving data is limited.
+	ConnDeadline time.Duration
+
+	// BackendAuthMessage optionally specifies a message explaining to the
+	// client that the target rejected the credentials of the proxy. As the
+	// client connection is established before the target is dialed, the
+	// message is sent by rejecting the first channel opened by the client,
+	// which clients such as OpenSSH display, waiting at most
+	// backendAuthMessageTimeout for it.
+	BackendAuthMessage string
+
+	// testClock replaces the real clock in tests, if non-nil.
+	testClock clock
+}
+
+var (
+	// ErrKeepAliveTimeout is returned by Serve when the target
+	// fails to reply to a keepalive request in time.
+	ErrKeepAliveTimeout = errors.New("sshproxy: keepalive timeout")
+
+	// ErrIdleTimeout is returned by Serve when no channel data
+	// has been proxied for the duration of the idle timeout.
+	ErrIdleTimeout = errors.New("sshproxy: idle timeout")
+
+	// ErrMaxSessionDuration is returned by Serve when the connection
+	// is closed for exceeding the maximum session duration.
+	ErrMaxSessionDuration = errors.New("sshproxy: max session duration exceeded")
+
+	// ErrClientClosed matches the error returned by Serve when the client
+	// connection closed first, such as when the client disconnects.
+	ErrClientClosed = errors.New("sshproxy: client connection closed")
+
+	// ErrTargetClosed matches the error returned by Serve when the target
+	// connection closed first, such as when the target disconnects.
+	ErrTargetClosed = errors.New("sshproxy: target connection closed")
+
+	// ErrProtocol matches the error returned by Serve when either connection
+	// failed due to an SSH protocol error, such as a malformed packet, rather
+	// than a disconnect or network error.
+	ErrProtocol = errors.New("sshproxy: ssh protocol error")
+
+	// ErrConnDeadline is returned by Serve when the connection to the
+	// target exceeds the read or write deadline of ConnDeadline.
+	ErrConnDeadline = errors.New("sshproxy: connection deadline exceeded")
+
+	// ErrBackendAuth is matched by the error returned by Serve when the
+	// target rejects the credentials of the proxy.
+	ErrBackendAuth = errors.New("sshproxy: target rejected authentication")
+
+	// ErrBackendHostKey is matched by the error returned by Serve when the
+	// HostKeyCallback of the target's client config rejects its host key.
+	ErrBackendHostKey = errors.New("sshproxy: target host key rejected")
+
+	// ErrBackendDial is matched by the error returned by Serve when the
+	// connection to the target fails for any reason other than
+	// authentication or host key verification, such as a network error or a
+	// failed handshake.
+	ErrBackendDial = errors.New("sshproxy: failed to connect to target")
+)
+
+// Hooks specifies optional callbacks invoked while proxying a connection.
+// Any nil field is ignored. Hooks may be called concurrently.
+//
+// Each callback is given a context derived from the one passed to Serve,
+// from which PermissionsFromContext returns the client's permissions.
+type Hooks struct {
+	// OnChannelOpen is called when either side opens a new channel,
+	// before it is opened on the opposite side.
+	OnChannelOpen func(ctx context.Context, channelType string, extraData []byte)
+
+	// OnChannelClose is called after a proxied channel has closed, with the
+	// number of bytes sent from the client to the target (bytesUp) and from
+	// the target to the client (bytesDown).
+	OnChannelClose func(ctx context.Context, channelType string, bytesUp, bytesDown int64)
+
+	// OnChannelStart is called once a proxied channel has been opened on both
+	// sides, before any data is copied. Calling cancel closes both ends of the
+	// channel without affecting other channels or the connection. It is safe
+	// to call cancel after the channel has closed.
+	OnChannelStart func(ctx context.Context, channelType string, cancel context.CancelFunc)
+
+	// OnRequest is called for each global or channel request
+	// before it is relayed.
+	OnRequest func(ctx context.Context, reqType string, wantReply bool)
+
+	// OnBreak is called for each "break" channel request, as used by serial
+	// consoles, with the requested length of the break in milliseconds,
+	// before it is relayed.
+	OnBreak func(ctx context.Context, lengthMs uint32)
+}
+
+func (h *Hooks) channelOpen(ctx context.Context, channelType string, extraData []byte) {
+	if h != nil && h.OnChannelOpen != nil {
+		h.OnChannelOpen(ctx, channelType, extraData)
+	}
+}
+
+func (h *Hooks) channelClose(ctx context.Context, channelType string, bytesUp, bytesDown int64) {
+	if h != nil && h.OnChannelClose != nil {
+		h.OnChannelClose(ctx, channelType, bytesUp, bytesDown)
+	}
+}
+
+func (h *Hooks) channelStart(ctx context.Context, channelType string, cancel context.CancelFunc) {
+	if h != nil && h.OnChannelStart != nil {
+		h.OnChannelStart(ctx, channelType, cancel)
+	}
 }
 
-// New constructs a new *ReverseProxy instance.
-func New(targetAddr string, clientConfig *ssh.ClientConfig) *ReverseProxy {
-	return &ReverseProxy{
+func (h *Hooks) request(ctx context.Context, reqType string, wantReply bool) {
+	if h != nil && h.OnRequest != nil {
+		h.OnRequest(ctx, reqType, wantReply)
+	}
+}
+
+// New constructs a new *ReverseProxy instance for the target at targetAddr,
+// configured by opts. Options are the preferred way to configure the
+// ReverseProxy, with one for each of its fields other than the target
+// address and client config; setting fields directly remains supported.
+func New(targetAddr string, clientConfig *ssh.ClientConfig, opts ...Option) *ReverseProxy {
+	r := &ReverseProxy{
 		TargetAddress:      targetAddr,
 		TargetClientConfig: clientConfig,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Proxy proxies an already-accepted server connection to the target at
+// targetAddr, using a ReverseProxy configured by opts. It is shorthand for
+// calling Serve on a new ReverseProxy.
+func Proxy(ctx context.Context, serverConn *ssh.ServerConn, serverChans <-chan ssh.NewChannel, serverReqs <-chan *ssh.Request, targetAddr string, clientConfig *ssh.ClientConfig, opts ...Option) error {
+	return New(targetAddr, clientConfig, opts...).Serve(ctx, serverConn, serverChans, serverReqs)
+}
+
+// ConnInfo describes a proxied connection.
+type ConnInfo struct {
+	// User and ClientAddr identify the client connection.
+	User       string
+	ClientAddr net.Addr
+	// TargetAddr is the address of the dialed target.
+	TargetAddr string
+	// Start is the time at which the target was dialed.
+	Start time.Time
+
+	// TargetServerVersion and TargetHostKey are the version string and host
+	// key presented by the target during the SSH handshake. They are only set
+	// when passed to OnDisconnect after a successful handshake.
+	TargetServerVersion string
+	TargetHostKey       ssh.PublicKey
+
+	// Duration and Err report the length of the connection and the error it
+	// terminated with. They are only set when passed to OnDisconnect.
+	Duration time.Duration
+	Err      error
+}
+
+// Stats reports the number of channel bytes proxied in each direction.
+type Stats struct {
+	BytesClientToTarget int64
+	BytesTargetToClient int64
+
+	// StderrBytesClientToTarget and StderrBytesTargetToClient count the
+	// extended data, such as the stderr of a session, which is included
+	// in the totals above.
+	StderrBytesClientToTarget int64
+	StderrBytesTargetToClient int64
 }
 
 // Serve executes the reverse proxy between the specified target client and the server connection.
+// When either connection closes, the returned error matches one of
+// ErrClientClosed, ErrTargetClosed, or ErrProtocol, and wraps the
+// error of the closed connection.
 func (r *ReverseProxy) Serve(ctx context.Context, serverConn *ssh.ServerConn, serverChans <-chan ssh.NewChannel, serverReqs <-chan *ssh.Request) error {
+	_, err := r.ServeWithStats(ctx, serverConn, serverChans, serverReqs)
+	return err
+}
+
+// ApplyAlgorithms sets the preferred algorithms of the reverse proxy on
+// config, such as the embedded Config of the ssh.ServerConfig used to accept
+// clients, such that both hops negotiate from the same algorithms. Algorithms
+// that are not specified are left unchanged.
+func (r *ReverseProxy) ApplyAlgorithms(config *ssh.Config) {
+	if r.PreferredCiphers != nil {
+		config.Ciphers = r.PreferredCiphers
+	}
+	if r.PreferredMACs != nil {
+		config.MACs = r.PreferredMACs
+	}
+	if r.PreferredKeyExchanges != nil {
+		config.KeyExchanges = r.PreferredKeyExchanges
+	}
+}
+
+// ServeWithStats is like Serve, but also returns the number of bytes proxied
+// in each direction across all channels of the connection.
+func (r *ReverseProxy) ServeWithStats(ctx context.Context, serverConn *ssh.ServerConn, serverChans <-chan ssh.NewChannel, serverReqs <-chan *ssh.Request) (stats Stats, err error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	if serverConn != nil && serverConn.Permissions != nil {
+		ctx = context.WithValue(ctx, permissionsKey{}, serverConn.Permissions)
+	}
 
-	var logger logger = defaultLogger{}
-	if r.ErrorLog != nil {
-		logger = r.ErrorLog
+	clk := r.clock()
+	conn := &proxyConn{proxy: r, client: serverConn, logger: r.logger(), failed: make(chan error, 1)}
+	conn.activity.clock = clk
+	if r.MaxInFlightBytes > 0 {
+		conn.budget = newByteBudget(r.MaxInFlightBytes)
 	}
+	ctx = context.WithValue(ctx, remoteForwardsKey{}, &conn.forwards)
 
-	// TODO: do we need to make "network" an argument?
-	targetConn, err := net.DialTimeout("tcp", r.TargetAddress, r.TargetClientConfig.Timeout)
-	if err != nil {
-		return fmt.Errorf("dial reverse proxy target: %w", err)
+	if r.ClientVersionFilter != nil && serverConn != nil {
+		version := string(serverConn.ClientVersion())
+		if err := r.ClientVersionFilter(ctx, version); err != nil {
+			err = fmt.Errorf("reject client version %q: %w", version, err)
+			conn.logger.Warn("sshproxy: ReverseProxy %v", err)
+			conn.logEvent(Event{Type: EventError, Err: err})
+			_ = serverConn.Close()
+			return Stats{}, err
+		}
+	}
+
+	if r.Authorizer != nil {
+		if err := r.Authorizer(ctx, serverConn); err != nil {
+			err = fmt.Errorf("authorize client: %w", err)
+			conn.logger.Warn("sshproxy: ReverseProxy %v", err)
+			conn.logEvent(Event{Type: EventError, Err: err})
+			if serverConn != nil {
+				_ = serverConn.Close()
+			}
+			return Stats{}, err
+		}
+	}
+
+	if r.EnforceCertOptions {
+		if err := conn.checkSourceAddress(); err != nil {
+			err = fmt.Errorf("enforce certificate options: %w", err)
+			conn.logger.Warn("sshproxy: ReverseProxy %v", err)
+			conn.logEvent(Event{Type: EventError, Err: err})
+			_ = serverConn.Close()
+			return Stats{}, err
+		}
 	}
-	defer targetConn.Close()
 
-	destConn, destChans, destReqs, err := ssh.NewClientConn(targetConn, r.TargetAddress, r.TargetClientConfig)
+	targetAddr, targetConfig := r.TargetAddress, r.TargetClientConfig
+	if r.TargetResolver != nil {
+		var err error
+		targetAddr, targetConfig, err = r.TargetResolver(ctx, serverConn)
+		if err != nil {
+			err = fmt.Errorf("resolve reverse proxy target: %w", err)
+			conn.logger.Error("sshproxy: ReverseProxy %v", err)
+			conn.logEvent(Event{Type: EventError, Err: err})
+			return Stats{}, err
+		}
+	}
+	conn.target = targetAddr
+
+	info := ConnInfo{TargetAddr: targetAddr}
+	if serverConn != nil {
+		info.User = serverConn.User()
+		info.ClientAddr = serverConn.RemoteAddr()
+	}
+	onDial := func() {
+		// only the first successful dial is reported
+		if !info.Start.IsZero() {
+			return
+		}
+		info.Start = clk.Now()
+		if r.OnConnect != nil {
+			r.OnConnect(info)
+		}
+	}
+	defer func() {
+		if !info.Start.IsZero() && r.OnDisconnect != nil {
+			info.Duration = clk.Now().Sub(info.Start)
+			info.Err = err
+			r.OnDisconnect(info, err)
+		}
+	}()
+
+	// capture and check the host key presented by the target and apply the
+	// preferred algorithms without modifying the caller's config
+	var hostKey ssh.PublicKey
+	if targetConfig != nil {
+		config := *targetConfig
+		if callback := targetConfig.HostKeyCallback; callback != nil {
+			config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				hostKey = key
+				conn.checkHostKey(targetAddr, key)
+				return callback(hostname, remote, key)
+			}
+		}
+		r.ApplyAlgorithms(&config.Config)
+		targetConfig = &config
+	}
+
+	var wrap func(net.Conn) net.Conn
+	if r.ConnDeadline > 0 {
+		wrap = func(targetConn net.Conn) net.Conn {
+			return newDeadlineConn(clk, targetConn, r.ConnDeadline, func() {
+				conn.logger.Warn("sshproxy: ReverseProxy %v", ErrConnDeadline)
+				conn.fail(ErrConnDeadline)
+			})
+		}
+	}
+	destConn, destChans, destReqs, err := r.connect(ctx, targetAddr, targetConfig, onDial, wrap)
 	if err != nil {
-		return fmt.Errorf("new ssh client conn: %w", err)
+		conn.logger.Error("sshproxy: ReverseProxy connect to target %s: %v", targetAddr, err)
+		conn.logEvent(Event{Type: EventError, Err: err})
+		if r.BackendAuthMessage != "" && errors.Is(err, ErrBackendAuth) {
+			r.rejectFirstChannel(ctx, serverChans, r.BackendAuthMessage)
+		}
+		return Stats{}, err
 	}
+	defer destConn.Close()
+	info.TargetServerVersion = string(destConn.ServerVersion())
+	info.TargetHostKey = hostKey
 
-	shutdownErr := make(chan error, 1)
+	start := clk.Now()
+	conn.logEvent(Event{Type: EventConnOpen})
+	metrics := r.metrics()
+	metrics.IncActiveConnections()
+	defer func() {
+		metrics.DecActiveConnections()
+		metrics.ObserveSessionDuration(clk.Now().Sub(start))
+		conn.logEvent(Event{
+			Type:     EventConnClose,
+			Stats:    stats,
+			Duration: clk.Now().Sub(start),
+			Err:      err,
+		})
+	}()
+
+	// wait on both connections, such that the teardown closes the client
+	// connection promptly if the target closes first, and vice versa
+	shutdownErr := make(chan error, 2)
+	go func() {
+		err := serverConn.Conn.Wait()
+		conn.markClosed(true)
+		shutdownErr <- err
+	}()
 	go func() {
-		shutdownErr <- serverConn.Conn.Wait()
+		err := destConn.Wait()
+		conn.markClosed(false)
+		shutdownErr <- err
 	}()
 
-	go processChannels(ctx, destConn, serverChans, logger)
-	go processChannels(ctx, serverConn.Conn, destChans, logger)
-	go processRequests(ctx, destConn, serverReqs, logger)
-	go processRequests(ctx, serverConn.Conn, destReqs, logger)
+	conn.activity.touch()
+	var relays sync.WaitGroup
+	relays.Add(4)
+	go func() {
+		defer relays.Done()
+		conn.processChannels(ctx, destConn, serverChans, true)
+	}()
+	go func() {
+		defer relays.Done()
+		conn.processChannels(ctx, serverConn.Conn, destChans, false)
+	}()
+	go func() {
+		defer relays.Done()
+		conn.processRequests(ctx, remoteForwardDest{destConn, &conn.forwards}, serverReqs, conn.clientGlobalRequestFilter(), nil, nil)
+	}()
+	go func() {
+		defer relays.Done()
+		conn.processRequests(ctx, serverConn.Conn, destReqs, conn.targetGlobalRequestFilter(), nil, nil)
+	}()
+	defer func() {
+		// tear down both connections and join the relays, such that
+		// errors caused by the teardown are not reported
+		cancel()
+		_ = serverConn.Close()
+		_ = destConn.Close()
+		relaysDone := make(chan struct{})
+		go func() {
+			relays.Wait()
+			close(relaysDone)
+		}()
+		timer := time.NewTimer(relayShutdownTimeout)
+		defer timer.Stop()
+		select {
+		case <-relaysDone:
+		case <-timer.C:
+		}
+	}()
+
+	// watchdogs report errors that cause the session to be torn down
+	watchdogErr := make(chan error, 3)
+	if r.KeepAlive > 0 {
+		go func() {
+			watchdogErr <- keepAlive(ctx, clk, destConn, r.KeepAlive)
+		}()
+	}
+	if r.IdleTimeout > 0 {
+		go func() {
+			watchdogErr <- conn.activity.watch(ctx, r.IdleTimeout)
+		}()
+	}
+	if r.MaxSessionDuration > 0 {
+		go func() {
+			timer := clk.NewTimer(r.MaxSessionDuration)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				watchdogErr <- ctx.Err()
+			case <-timer.C():
+				watchdogErr <- ErrMaxSessionDuration
+			}
+		}()
+	}
 
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return conn.stats(), ctx.Err()
 	case err := <-shutdownErr:
-		return err
+		return conn.stats(), conn.closeError(err)
+	case err := <-watchdogErr:
+		_ = serverConn.Close()
+		return conn.stats(), err
+	case err := <-conn.failed:
+		_ = serverConn.Close()
+		return conn.stats(), err
 	}
 }
 
-type defaultLogger struct{}
+// fail tears down the connection, causing Serve to return err,
+// unless the connection has already failed.
+func (c *proxyConn) fail(err error) {
+	select {
+	case c.failed <- err:
+	default:
+	}
+}
 
-// wrap the default logger
-func (defaultLogger) Printf(format string, v ...any) { log.Printf(format, v...) }
+// relayShutdownTimeout bounds how long Serve waits for
+// the relay goroutines to exit before returning. It is measured
+// with the real clock, such that fake clocks cannot stall Serve.
+const relayShutdownTimeout = time.Second
 
-type logger interface {
-	Printf(format string, v ...any)
+// isTeardownError reports whether err was caused by either connection
+// closing or the context being cancelled, rather than a proxying failure.
+func isTeardownError(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, context.Canceled)
 }
 
-// processChannels handles each ssh.NewChannel concurrently.
-func processChannels(ctx context.Context, destConn ssh.Conn, chans <-chan ssh.NewChannel, logger logger) {
-	defer destConn.Close()
+// keepAlive sends a keepalive request to conn every interval until the
+// context is cancelled, returning ErrKeepAliveTimeout if a reply is not
+// received within the interval.
+func keepAlive(ctx context.Context, clk clock, conn ssh.Conn, interval time.Duration) error {
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			// any reply, including failure, indicates that the target is alive
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		timer := clk.NewTimer(interval)
+		select {
+		case err := <-replied:
+			timer.Stop()
+			if err != nil {
+				return fmt.Errorf("send keepalive: %w", err)
+			}
+		case <-timer.C():
+			return ErrKeepAliveTimeout
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// connect dials the target and establishes an SSH client connection over it,
+// making up to DialAttempts attempts. onDial is called after each successful
+// dial, and each dialed connection is wrapped by the optional wrap function.
+// Failures to authenticate with the target or to verify its host key are not
+// retried. Errors match one of ErrBackendAuth, ErrBackendHostKey or
+// ErrBackendDial, unless ctx is done.
+func (r *ReverseProxy) connect(ctx context.Context, addr string, config *ssh.ClientConfig, onDial func(), wrap func(net.Conn) net.Conn) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	clk := r.clock()
+	if r.DialClient != nil {
+		start := clk.Now()
+		destConn, destChans, destReqs, err := r.DialClient(ctx)
+		if err != nil {
+			return nil, nil, nil, newConnectError(fmt.Errorf("dial reverse proxy target client: %w", err))
+		}
+		r.metrics().ObserveBackendHandshakeLatency(clk.Now().Sub(start))
+		onDial()
+		return destConn, destChans, destReqs, nil
+	}
+
+	// the handshake error does not wrap the error of the host key callback,
+	// so it is recorded separately
+	var hostKeyErr error
+	if config != nil && config.HostKeyCallback != nil {
+		callback := config.HostKeyCallback
+		copied := *config
+		config = &copied
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = callback(hostname, remote, key)
+			return hostKeyErr
+		}
+	}
+
+	var err error
+	backoff := r.DialBackoff
+	for attempt := 0; attempt < r.DialAttempts || attempt == 0; attempt++ {
+		if attempt > 0 {
+			timer := clk.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, nil, nil, ctx.Err()
+			case <-timer.C():
+			}
+			backoff *= 2
+		}
+
+		start := clk.Now()
+		var targetConn net.Conn
+		targetConn, err = r.dial(ctx, addr, config)
+		if err != nil {
+			err = fmt.Errorf("dial reverse proxy target: %w", err)
+			continue
+		}
+		onDial()
+		if wrap != nil {
+			targetConn = wrap(targetConn)
+		}
+
+		var destConn ssh.Conn
+		var destChans <-chan ssh.NewChannel
+		var destReqs <-chan *ssh.Request
+		destConn, destChans, destReqs, err = ssh.NewClientConn(targetConn, addr, config)
+		if err != nil {
+			targetConn.Close()
+			if hostKeyErr != nil {
+				err = fmt.Errorf("verify target host key: %w", hostKeyErr)
+				return nil, nil, nil, &connectError{reason: ErrBackendHostKey, err: err}
+			}
+			err = fmt.Errorf("new ssh client conn: %w", err)
+			if isAuthError(err) {
+				return nil, nil, nil, newConnectError(err)
+			}
+			continue
+		}
+		r.metrics().ObserveBackendHandshakeLatency(clk.Now().Sub(start))
+		return destConn, destChans, destReqs, nil
+	}
+	return nil, nil, nil, newConnectError(err)
+}
+
+// connectError wraps a failure to connect to the target, matching one of
+// ErrBackendAuth, ErrBackendHostKey or ErrBackendDial with errors.Is in
+// addition to the wrapped error, without altering its message.
+type connectError struct {
+	reason error
+	err    error
+}
+
+func newConnectError(err error) error {
+	reason := ErrBackendDial
+	if isAuthError(err) {
+		reason = ErrBackendAuth
+	}
+	return &connectError{reason: reason, err: err}
+}
+
+func (e *connectError) Error() string { return e.err.Error() }
+
+func (e *connectError) Unwrap() error { return e.err }
+
+func (e *connectError) Is(target error) bool { return target == e.reason }
+
+// backendAuthMessageTimeout bounds how long BackendAuthMessage waits for the
+// client to open a channel.
+const backendAuthMessageTimeout = 5 * time.Second
+
+// rejectFirstChannel rejects the next channel opened by the client with msg,
+// returning early if ctx is done or no channel is opened in time.
+func (r *ReverseProxy) rejectFirstChannel(ctx context.Context, chans <-chan ssh.NewChannel, msg string) {
+	if chans == nil {
+		return
+	}
+	timer := r.clock().NewTimer(backendAuthMessageTimeout)
+	defer timer.Stop()
+	select {
+	case newChannel, ok := <-chans:
+		if ok {
+			_ = newChannel.Reject(ssh.ConnectionFailed, msg)
+		}
+	case <-ctx.Done():
+	case <-timer.C():
+	}
+}
+
+// isAuthError reports whether err is the result of the target rejecting all
+// authentication methods, including when no methods are supported or a
+// method only partially succeeded. The ssh package does not export a typed error for
+// this, so the error message is inspected.
+func isAuthError(err error) bool {
+	return strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// dial connects to the target address using the configured network and dialer.
+func (r *ReverseProxy) dial(ctx context.Context, addr string, config *ssh.ClientConfig) (net.Conn, error) {
+	network := r.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if r.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.DialTimeout)
+		defer cancel()
+	}
+	if r.Dial != nil {
+		return r.Dial(ctx, network, addr)
+	}
+	if net.ParseIP(addr) != nil {
+		// a bare IPv6 literal is otherwise reported as having too many colons
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "missing port in address", Addr: addr}}
+	}
+	dialer := net.Dialer{}
+	if r.DialTimeout == 0 {
+		dialer.Timeout = config.Timeout
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// proxyConn holds the state shared by the relay goroutines
+// of a single proxied connection.
+type proxyConn struct {
+	proxy  *ReverseProxy
+	client *ssh.ServerConn
+	target string
+	logger LeveledLogger
+
+	// bytesToTarget, bytesToClient, stderrToTarget, stderrToClient,
+	// channels, and closedBy are updated atomically.
+	bytesToTarget  int64
+	bytesToClient  int64
+	stderrToTarget int64
+	stderrToClient int64
+	channels       int64
+	closedBy       int32
+
+	activity activityTracker
+
+	// budget limits the bytes in flight if MaxInFlightBytes is set.
+	budget *byteBudget
+
+	// forwards are the remote port forwards granted to the client.
+	forwards remoteForwards
+
+	// failed receives an error that causes the connection to be torn down.
+	failed chan error
+}
+
+func (c *proxyConn) stats() Stats {
+	return Stats{
+		BytesClientToTarget: atomic.LoadInt64(&c.bytesToTarget),
+		BytesTargetToClient: atomic.LoadInt64(&c.bytesToClient),
+
+		StderrBytesClientToTarget: atomic.LoadInt64(&c.stderrToTarget),
+		StderrBytesTargetToClient: atomic.LoadInt64(&c.stderrToClient),
+	}
+}
+
+// processChannels handles each ssh.NewChannel concurrently. fromClient reports
+// whether the channels were opened by the client, rather than the target.
+func (c *proxyConn) processChannels(ctx context.Context, destConn ssh.Conn, chans <-chan ssh.NewChannel, fromClient bool) {
+	defer func() {
+		// the connection of the channels has closed, which
+		// is attributed before closing the opposite side
+		c.markClosed(fromClient)
+		_ = destConn.Close()
+	}()
 	for newCh := range chans {
 		// reset the var scope for each goroutine
 		newCh := newCh
 		go func() {
-			err := handleChannel(ctx, destConn, newCh, logger)
-			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
-				logger.Printf("sshproxy: ReverseProxy handle channel error: %v", err)
+			err := c.handleChannel(ctx, destConn, newCh, fromClient)
+			if err != nil && !isTeardownError(ctx, err) {
+				c.logger.Warn("sshproxy: ReverseProxy handle channel error: %v", err)
+				c.logEvent(Event{Type: EventError, ChannelType: newCh.ChannelType(), Err: err})
 			}
 		}()
 	}
 }
 
-// processRequests handles each *ssh.Request in series.
-func processRequests(ctx context.Context, dest requestDest, requests <-chan *ssh.Request, logger logger) {
+// processRequests handles each *ssh.Request in series, independently of the
+// copying of channel data, such that requests like "window-change" are not
+// delayed by output and are not relayed ahead of the "pty-req" they depend
+// on. Requests rejected by the optional filter are not relayed, replying with
+// failure if a reply is wanted. Relayed requests are modified by the optional
+// rewrite, and requests for which it returns an error are rejected like
+// filtered requests. If inFlight is non-nil, it is held while
+// each request is being handled.
+func (c *proxyConn) processRequests(ctx context.Context, dest requestDest, requests <-chan *ssh.Request, filter requestFilter, rewrite requestRewrite, inFlight *sync.Mutex) {
 	for req := range requests {
+		c.proxy.Hooks.request(ctx, req.Type, req.WantReply)
+		if req.Type == breakRequestType {
+			c.proxy.Hooks.breakRequest(ctx, req.Payload)
+		}
+		c.logEvent(Event{Type: EventRequest, RequestType: req.Type, WantReply: req.WantReply})
+		if filter != nil && !filter(ctx, req.Type, req.Payload) {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+		if rewrite != nil {
+			reqType := req.Type
+			if err := rewrite(ctx, req); err != nil {
+				c.logger.Info("sshproxy: ReverseProxy reject %s request: %v", reqType, err)
+				if req.WantReply {
+					_ = req.Reply(false, nil)
+				}
+				continue
+			}
+		}
+		if inFlight != nil {
+			inFlight.Lock()
+		}
 		err := handleRequest(ctx, dest, req)
-		if err != nil && !errors.Is(err, io.EOF) {
-			logger.Printf("sshproxy: ReverseProxy handle request error: %v", err)
+		if inFlight != nil {
+			inFlight.Unlock()
+		}
+		if err != nil && !isTeardownError(ctx, err) {
+			c.logger.Warn("sshproxy: ReverseProxy handle request error: %v", err)
+			c.logEvent(Event{Type: EventError, RequestType: req.Type, Err: err})
 		}
 	}
 }
 
 // handleChannel performs the bicopy between the destination SSH connection and a
 // new incoming channel.
-func handleChannel(ctx context.Context, destConn ssh.Conn, newChannel ssh.NewChannel, logger logger) error {
+func (c *proxyConn) handleChannel(ctx context.Context, destConn ssh.Conn, newChannel ssh.NewChannel, fromClient bool) error {
+	c.proxy.Hooks.channelOpen(ctx, newChannel.ChannelType(), newChannel.ExtraData())
+	c.logEvent(Event{Type: EventChannelOpen, ChannelType: newChannel.ChannelType()})
+
+	if c.proxy.InspectChannel != nil {
+		if err := c.proxy.InspectChannel(ctx, newChannel.ChannelType(), newChannel.ExtraData()); err != nil {
+			_ = newChannel.Reject(ssh.Prohibited, err.Error())
+			return nil
+		}
+	}
+	if fromClient && c.proxy.ChannelFilter != nil && !c.proxy.ChannelFilter(ctx, newChannel.ChannelType(), newChannel.ExtraData()) {
+		_ = newChannel.Reject(ssh.Prohibited, fmt.Sprintf("channel type %q is not permitted", newChannel.ChannelType()))
+		return nil
+	}
+	if fromClient && c.proxy.ForwardFilter != nil && isLocalForward(newChannel.ChannelType()) {
+		if reason, ok := c.allowForward(ctx, newChannel.ChannelType(), newChannel.ExtraData()); !ok {
+			_ = newChannel.Reject(ssh.Prohibited, reason)
+			return nil
+		}
+	}
+	if !fromClient && c.proxy.TargetChannelFilter != nil && !c.proxy.TargetChannelFilter(ctx, newChannel.ChannelType(), newChannel.ExtraData()) {
+		_ = newChannel.Reject(ssh.Prohibited, fmt.Sprintf("channel type %q is not permitted", newChannel.ChannelType()))
+		return nil
+	}
+	if !fromClient && newChannel.ChannelType() == agentChannelType && c.proxy.DisableAgentForwarding {
+		_ = newChannel.Reject(ssh.Prohibited, "agent forwarding is not permitted")
+		return nil
+	}
+
+	if n := atomic.AddInt64(&c.channels, 1); c.proxy.MaxChannelsPerConn > 0 && n > int64(c.proxy.MaxChannelsPerConn) {
+		atomic.AddInt64(&c.channels, -1)
+		_ = newChannel.Reject(ssh.ResourceShortage, "too many open channels")
+		return nil
+	}
+	defer atomic.AddInt64(&c.channels, -1)
+
+	var rec *recording
+	if fromClient && newChannel.ChannelType() == "session" && c.proxy.Recorder != nil {
+		w, err := c.proxy.Recorder.Record(c.client)
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, "failed to record session")
+			return fmt.Errorf("record session: %w", err)
+		}
+		if w != nil {
+			rec = newRecording(w, c.logger, c.proxy.clock())
+		}
+	}
+
+	openStart := c.proxy.clock().Now()
 	destCh, destReqs, err := destConn.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if fromClient {
+		c.proxy.metrics().ObserveChannelOpenLatency(newChannel.ChannelType(), c.proxy.clock().Now().Sub(openStart))
+	}
 	if err != nil {
-		if openChanErr, ok := err.(*ssh.OpenChannelError); ok {
+		rec.close()
+		// preserve the target's reason, such as ssh.ResourceShortage,
+		// even if the error has been wrapped by the connection
+		var openChanErr *ssh.OpenChannelError
+		if errors.As(err, &openChanErr) {
 			_ = newChannel.Reject(openChanErr.Reason, openChanErr.Message)
 		} else {
 			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
@@ -121,47 +1185,145 @@ func handleChannel(ctx context.Context, destConn ssh.Conn, newChannel ssh.NewCha
 
 	originCh, originRequests, err := newChannel.Accept()
 	if err != nil {
+		rec.close()
 		return fmt.Errorf("accept new channel: %w", err)
 	}
 	defer originCh.Close()
+	c.proxy.metrics().IncChannelsByType(newChannel.ChannelType())
+
+	// each channel may be cancelled on its own, aborting the bicopy
+	// and closing both ends through the deferred closures above
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.proxy.Hooks.channelStart(ctx, newChannel.ChannelType(), cancel)
+
+	if fromClient && newChannel.ChannelType() == "session" {
+		c.injectEnv(destCh)
+	}
+
+	// the answers to re-authentication challenges are not recorded
+	var reauth *reAuth
+	if fromClient && newChannel.ChannelType() == "session" {
+		if reauth = c.newReAuth(ctx, originCh); reauth != nil {
+			originCh = reAuthChannel{originCh, reauth}
+		}
+	}
+
+	if rec != nil {
+		originCh = newRecordedChannel(originCh, rec, "i")
+		destCh = newRecordedChannel(destCh, rec, "o")
+	}
+	originCh, destCh = c.rateLimitChannels(ctx, originCh, destCh)
+
+	stats := channelStats{
+		alphaTotal: &c.bytesToClient, betaTotal: &c.bytesToTarget,
+		alphaStderr: &c.stderrToClient, betaStderr: &c.stderrToTarget,
+	}
+	if !c.proxy.copiesStderr(newChannel.ChannelType()) {
+		stats.alphaStderr, stats.betaStderr = nil, nil
+	}
+	if !fromClient {
+		stats.alphaTotal, stats.betaTotal = stats.betaTotal, stats.alphaTotal
+		stats.alphaStderr, stats.betaStderr = stats.betaStderr, stats.alphaStderr
+	}
+	defer func() {
+		// report once both copies have exited, which is guaranteed
+		// after the deferred channel closures
+		go func() {
+			stats.wg.Wait()
+			rec.close()
+			up, down := stats.beta, stats.alpha
+			if !fromClient {
+				up, down = down, up
+			}
+			c.proxy.Hooks.channelClose(ctx, newChannel.ChannelType(), up, down)
+			metrics := c.proxy.metrics()
+			metrics.AddBytes(ClientToTarget, up)
+			metrics.AddBytes(TargetToClient, down)
+		}()
+	}()
+
+	// only requests sent by the client are filtered, and requests are
+	// rewritten according to their direction
+	var originFilter, destFilter = c.clientRequestFilter(), requestFilter(nil)
+	var originRewrite, destRewrite = chainRewrites(c.clientRequestRewrite(), reauth.rewrite()), c.proxy.exitRewrite(newChannel.ChannelType())
+	if !fromClient {
+		originFilter, destFilter = destFilter, originFilter
+		originRewrite, destRewrite = destRewrite, originRewrite
+	}
 
 	destRequestsDone := make(chan struct{})
 	go func() {
 		defer close(destRequestsDone)
-		processRequests(ctx, channelRequestDest{originCh}, destReqs, logger)
+		c.processRequests(ctx, channelRequestDest{originCh}, destReqs, destFilter, destRewrite, nil)
 	}()
 
 	// This request channel does not get closed
 	// by the client causing this function to hang if we wait on it.
-	go processRequests(ctx, channelRequestDest{destCh}, originRequests, logger)
+	// Instead, wait for any in-flight request before closing the channels
+	// so that its reply is not lost when the target closes quickly.
+	var originRequestInFlight sync.Mutex
+	go c.processRequests(ctx, channelRequestDest{destCh}, originRequests, originFilter, originRewrite, &originRequestInFlight)
 
-	if err := bicopy(ctx, originCh, destCh, logger); err != nil {
+	if err := c.bicopy(ctx, originCh, destCh, &stats); err != nil {
 		return fmt.Errorf("channel bidirectional copy: %w", err)
 	}
 
 	select {
 	case <-destRequestsDone:
+		originRequestInFlight.Lock()
+		defer originRequestInFlight.Unlock()
 		return nil
 	case <-ctx.Done():
 		return ctx.Err()
 	}
 }
 
+// channelStats counts the bytes written to each end of a bicopy.
+// The counts are final once wg has completed. Writes are also
+// accumulated into the connection-wide totals as they occur.
+type channelStats struct {
+	alpha, beta             int64
+	alphaTotal, betaTotal   *int64
+	alphaStderr, betaStderr *int64
+	wg                      sync.WaitGroup
+}
+
 // bicopy copies data between the two channels,
 // but does not perform complete closure.
 // It will block until the context is cancelled or the `alpha` channel
-// has completed writing its data. Writes from the `beta` channel are not
-// waited on.
-func bicopy(ctx context.Context, alpha, beta ssh.Channel, logger logger) error {
+// has completed writing its data. Writes from the `beta` channel are only
+// waited on for up to the HalfCloseGrace period, if any.
+func (c *proxyConn) bicopy(ctx context.Context, alpha, beta ssh.Channel, stats *channelStats) error {
 	alphaWriteDone := make(chan struct{})
+	betaWriteDone := make(chan struct{})
+	stats.wg.Add(2)
 	go func() {
+		defer stats.wg.Done()
 		defer close(alphaWriteDone)
-		copyChannels(alpha, beta, logger)
+		stats.alpha = c.copyChannels(alpha, beta, stats.alphaTotal, stats.alphaStderr)
+	}()
+	go func() {
+		defer stats.wg.Done()
+		defer close(betaWriteDone)
+		stats.beta = c.copyChannels(beta, alpha, stats.betaTotal, stats.betaStderr)
 	}()
-	go copyChannels(beta, alpha, logger)
 
 	select {
 	case <-alphaWriteDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if c.proxy.HalfCloseGrace <= 0 {
+		return nil
+	}
+	timer := c.proxy.clock().NewTimer(c.proxy.HalfCloseGrace)
+	defer timer.Stop()
+	select {
+	case <-betaWriteDone:
+		return nil
+	case <-timer.C():
 		return nil
 	case <-ctx.Done():
 		return ctx.Err()
@@ -171,23 +1333,177 @@ func bicopy(ctx context.Context, alpha, beta ssh.Channel, logger logger) error {
 // copyChannels pipes data from the writer to the reader channel, calling
 // w.CloseWrite when writes have completed. This operation blocks until
 // both the stderr and primary copy streams exit. Non EOF errors are logged
-// to the given logger.
-func copyChannels(w, r ssh.Channel, logger logger) {
+// to the connection's logger. It returns the total number of bytes written
+// to w across both streams, which are also atomically added to total as
+// they are written. Bytes written to the stderr stream are also added
+// to stderrTotal. If stderrTotal is nil, the stderr stream is not copied.
+func (c *proxyConn) copyChannels(w, r ssh.Channel, total, stderrTotal *int64) int64 {
 	defer func() { _ = w.CloseWrite() }()
 
+	var primary, stderr io.Writer = w, w.Stderr()
+	if timeout := c.proxy.WriteTimeout; timeout > 0 {
+		clk := c.proxy.clock()
+		primaryWrites, stderrWrites := pendingWrite{clock: clk}, pendingWrite{clock: clk}
+		primary = stallWriter{primary, &primaryWrites}
+		stderr = stallWriter{stderr, &stderrWrites}
+
+		watchDone := make(chan struct{})
+		defer close(watchDone)
+		go func() {
+			if watchStalls(clk, watchDone, timeout, &primaryWrites, &stderrWrites) {
+				c.logger.Warn("sshproxy: bicopy channel: write stalled for %v, closing channel", timeout)
+				_ = w.Close()
+				_ = r.Close()
+			}
+		}()
+	}
+
+	pool := c.proxy.bufferPool()
+	copyStream := func(w io.Writer, r io.Reader) int64 {
+		throttledW, throttledR := c.throttle(countingWriter{w, total, &c.activity}, r)
+		n, err := copyBuffer(throttledW, throttledR, pool)
+		if err != nil && !errors.Is(err, io.EOF) {
+			c.logger.Debug("sshproxy: bicopy channel: %v", err)
+		}
+		return n
+	}
+	if stderrTotal == nil {
+		return copyStream(primary, r)
+	}
+
+	var written int64
 	copyDone := make(chan struct{})
 	go func() {
 		defer close(copyDone)
-		_, err := io.Copy(w, r)
-		if err != nil && !errors.Is(err, io.EOF) {
-			logger.Printf("sshproxy: bicopy channel: %v", err)
-		}
+		written = copyStream(primary, r)
 	}()
-	_, err := io.Copy(w.Stderr(), r.Stderr())
-	if err != nil && !errors.Is(err, io.EOF) {
-		logger.Printf("sshproxy: bicopy channel: %v", err)
-	}
+	n := copyStream(countingWriter{stderr, stderrTotal, &c.activity}, r.Stderr())
 	<-copyDone
+	return written + n
+}
+
+// defaultNoStderrChannelTypes are the channel types
+// without a stderr stream, used when NoStderrChannelTypes is nil.
+var defaultNoStderrChannelTypes = []string{
+	directTCPIPChannelType,
+	"forwarded-tcpip",
+	directStreamLocalChannelType,
+	"forwarded-streamlocal@openssh.com",
+	"x11",
+	agentChannelType,
+}
+
+// copiesStderr reports whether the stderr stream of channels of the given
+// type is copied, according to NoStderrChannelTypes.
+func (r *ReverseProxy) copiesStderr(channelType string) bool {
+	skip := r.NoStderrChannelTypes
+	if skip == nil {
+		skip = defaultNoStderrChannelTypes
+	}
+	for _, t := range skip {
+		if t == channelType {
+			return false
+		}
+	}
+	return true
+}
+
+// countingWriter atomically adds the number of bytes written to n,
+// recording each write in activity.
+type countingWriter struct {
+	io.Writer
+	n        *int64
+	activity *activityTracker
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	c.activity.touch()
+	return n, err
+}
+
+// pendingWrite records the start time of an in-progress write.
+type pendingWrite struct {
+	clock clock
+	// started is a unix nanosecond timestamp, or zero when no write is in
+	// progress, updated atomically
+	started int64
+}
+
+// stalled reports whether a write has been in progress for at least timeout.
+func (p *pendingWrite) stalled(timeout time.Duration) bool {
+	started := atomic.LoadInt64(&p.started)
+	return started != 0 && p.clock.Now().Sub(time.Unix(0, started)) >= timeout
+}
+
+// stallWriter records each write to the underlying writer in pending.
+type stallWriter struct {
+	io.Writer
+	pending *pendingWrite
+}
+
+func (s stallWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(&s.pending.started, s.pending.clock.Now().UnixNano())
+	defer atomic.StoreInt64(&s.pending.started, 0)
+	return s.Writer.Write(p)
+}
+
+// watchStalls blocks until done is closed, returning false, or until one of
+// the pending writes has stalled for the timeout, returning true.
+func watchStalls(clk clock, done <-chan struct{}, timeout time.Duration, pending ...*pendingWrite) bool {
+	ticker := clk.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return false
+		case <-ticker.C():
+		}
+		for _, p := range pending {
+			if p.stalled(timeout) {
+				return true
+			}
+		}
+	}
+}
+
+// activityTracker records the time of the most recent channel activity.
+type activityTracker struct {
+	// clock is the real clock if nil
+	clock clock
+	// last is a unix nanosecond timestamp, updated atomically
+	last int64
+}
+
+func (a *activityTracker) now() time.Time {
+	if a.clock == nil {
+		return time.Now()
+	}
+	return a.clock.Now()
+}
+
+func (a *activityTracker) touch() {
+	atomic.StoreInt64(&a.last, a.now().UnixNano())
+}
+
+// watch blocks until the context is cancelled, or there has been no activity
+// for the given timeout, in which case ErrIdleTimeout is returned.
+func (a *activityTracker) watch(ctx context.Context, timeout time.Duration) error {
+	timer := a.clock.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C():
+		}
+		idle := a.now().Sub(time.Unix(0, atomic.LoadInt64(&a.last)))
+		if idle >= timeout {
+			return ErrIdleTimeout
+		}
+		timer.Reset(timeout - idle)
+	}
 }
 
 // channelRequestDest wraps the ssh.Channel type to conform with the standard
@@ -198,12 +1514,123 @@ type channelRequestDest struct {
 	ssh.Channel
 }
 
+var (
+	_ requestDest = ssh.Conn(nil)
+	_ requestDest = channelRequestDest{}
+)
+
 func (c channelRequestDest) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
 	ok, err := c.Channel.SendRequest(name, wantReply, payload)
 	return ok, nil, err
 }
 
+// requestFilter reports whether a request should be relayed.
+type requestFilter func(ctx context.Context, reqType string, payload []byte) bool
+
+// requestRewrite modifies the type or payload of a request before it is
+// relayed, or returns an error if the request should be rejected.
+type requestRewrite func(ctx context.Context, req *ssh.Request) error
+
+// chainRewrites returns a requestRewrite applying each non-nil rewrite in
+// order, or nil if there are none.
+func chainRewrites(rewrites ...requestRewrite) requestRewrite {
+	var chain []requestRewrite
+	for _, rewrite := range rewrites {
+		if rewrite != nil {
+			chain = append(chain, rewrite)
+		}
+	}
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	}
+	return func(ctx context.Context, req *ssh.Request) error {
+		for _, rewrite := range chain {
+			if err := rewrite(ctx, req); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+const (
+	agentRequestType = "auth-agent-req@openssh.com"
+	agentChannelType = "auth-agent@openssh.com"
+)
+
+// clientRequestFilter returns the filter for channel requests sent by the
+// client, combining RequestFilter with DisableAgentForwarding and
+// SubsystemFilter.
+func (c *proxyConn) clientRequestFilter() requestFilter {
+	if !c.proxy.DisableAgentForwarding && c.proxy.SubsystemFilter == nil && c.proxy.SignalFilter == nil {
+		return c.proxy.RequestFilter
+	}
+	return func(ctx context.Context, reqType string, payload []byte) bool {
+		switch reqType {
+		case agentRequestType:
+			if c.proxy.DisableAgentForwarding {
+				return false
+			}
+		case subsystemRequestType:
+			if c.proxy.SubsystemFilter != nil && !c.allowSubsystem(ctx, payload) {
+				return false
+			}
+		case signalRequestType:
+			if c.proxy.SignalFilter != nil && !c.allowSignal(ctx, payload) {
+				return false
+			}
+		}
+		return c.proxy.RequestFilter == nil || c.proxy.RequestFilter(ctx, reqType, payload)
+	}
+}
+
+// injectEnv sends the InjectEnv and ClientAddrEnv variables
+// to the target session channel.
+func (c *proxyConn) injectEnv(ch ssh.Channel) {
+	env := c.proxy.InjectEnv
+	if c.proxy.ClientAddrEnv != "" && c.client != nil {
+		env = make(map[string]string, len(c.proxy.InjectEnv)+1)
+		for key, value := range c.proxy.InjectEnv {
+			env[key] = value
+		}
+		env[c.proxy.ClientAddrEnv] = c.client.RemoteAddr().String()
+	}
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		payload := ssh.Marshal(struct{ Name, Value string }{key, env[key]})
+		ok, err := ch.SendRequest("env", true, payload)
+		if err == nil && !ok {
+			err = errors.New("rejected by target")
+		}
+		if err != nil {
+			err = fmt.Errorf("inject env %s: %w", key, err)
+			c.logger.Warn("sshproxy: ReverseProxy %v", err)
+			c.logEvent(Event{Type: EventError, RequestType: "env", Err: err})
+		}
+	}
+}
+
+// clientRequestRewrite returns the rewrite for channel requests sent by the
+// client, combining PtyRewrite, CommandRewrite, and EnforceCertOptions. The
+// forced command is applied last, such that it cannot be rewritten.
+func (c *proxyConn) clientRequestRewrite() requestRewrite {
+	return chainRewrites(c.proxy.ptyRewrite(), c.proxy.commandRewrite(), c.forceCommandRewrite())
+}
+
 // requestDest defines a resource capable of receiving requests, (global or channel).
+//
+// Global requests are relayed to the ssh.Conn of the other side, whose
+// SendRequest returns the reply payload, such as for
+// "hostkeys-prove-00@openssh.com". Channel requests are relayed to a
+// channelRequestDest, as replies to channel requests carry no payload.
 type requestDest interface {
 	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
 }
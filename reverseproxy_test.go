@@ -1,17 +1,24 @@
 package sshproxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,10 +31,19 @@ var (
 	password = flag.String("ssh-passwd", "", "specify the password with which to dial")
 )
 
+func Test_reverseProxyInProcess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveOpenSSH), testClientConfig())
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testSSHClient(t, client)
+}
+
 func Test_reverseProxy(t *testing.T) {
 	t.Parallel()
 	if *addr == "" || *user == "" || *password == "" {
-		t.Fatalf("-ssh-addr, -ssh-user, and -ssh-passwd are all required flags")
+		t.Skip("-ssh-addr, -ssh-user, and -ssh-passwd are all required to test against an external target")
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -101,6 +117,53 @@ func Test_dialFailure(t *testing.T) {
 	}
 }
 
+func Test_dialFailureIPv6(t *testing.T) {
+	for _, addr := range []string{"::1", "[::1]"} {
+		proxy := New(addr, testClientConfig())
+		err := proxy.Serve(context.Background(), nil, nil, nil)
+		expected := fmt.Sprintf("dial reverse proxy target: dial tcp: address %s: missing port in address", addr)
+		if err == nil || err.Error() != expected {
+			t.Fatalf("expected %q, got: %v", expected, err)
+		}
+	}
+}
+
+func Test_ipv6Target(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	backendAddr := newTestBackend(t, serveSessions)
+	go func() {
+		// forward the IPv6 listener to the backend
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				backend, err := net.Dial("tcp", backendAddr)
+				if err != nil {
+					return
+				}
+				defer backend.Close()
+				go func() { _, _ = io.Copy(backend, conn) }()
+				_, _ = io.Copy(conn, backend)
+			}()
+		}
+	}()
+	defer l.Close()
+
+	// the target address is of the form "[::1]:port"
+	proxy := New(l.Addr().String(), testClientConfig())
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+}
+
 func Test_serverConnFailure(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -136,6 +199,1586 @@ func Test_serverConnFailure(t *testing.T) {
 	}
 }
 
+func Test_customDialer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, serveSessions)
+
+	var dialedNetwork, dialedAddr string
+	proxy := New("backend", testClientConfig())
+	proxy.Network = "tcp4"
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialedNetwork, dialedAddr = network, addr
+		var d net.Dialer
+		return d.DialContext(ctx, network, backendAddr)
+	}
+
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+
+	if dialedNetwork != "tcp4" || dialedAddr != "backend" {
+		t.Fatalf("unexpected dial arguments, got (%s, %s)", dialedNetwork, dialedAddr)
+	}
+}
+
+func Test_dialContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	proxy := New("backend", testClientConfig())
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		cancel()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	err := proxy.Serve(ctx, nil, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func Test_dialTimeout(t *testing.T) {
+	config := testClientConfig()
+	config.Timeout = time.Minute
+
+	proxy := New("backend", config)
+	proxy.DialTimeout = 50 * time.Millisecond
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	start := time.Now()
+	err := proxy.Serve(context.Background(), nil, nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected dial timeout to apply, returned after %v", elapsed)
+	}
+}
+
+func Test_hooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type closeEvent struct {
+		channelType        string
+		bytesUp, bytesDown int64
+	}
+	opened := make(chan string, 1)
+	closed := make(chan closeEvent, 1)
+	var mu sync.Mutex
+	var requests []string
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.Hooks = &Hooks{
+		OnChannelOpen: func(_ context.Context, channelType string, extraData []byte) {
+			opened <- channelType
+		},
+		OnChannelClose: func(_ context.Context, channelType string, bytesUp, bytesDown int64) {
+			closed <- closeEvent{channelType, bytesUp, bytesDown}
+		},
+		OnRequest: func(_ context.Context, reqType string, wantReply bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			requests = append(requests, reqType)
+		},
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testStdin(t, client)
+
+	if typ := <-opened; typ != "session" {
+		t.Fatalf("unexpected opened channel type, got %s", typ)
+	}
+	event := <-closed
+	if event != (closeEvent{"session", 8, 8}) {
+		t.Fatalf("unexpected channel close event, got %+v", event)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(requests, ",") != "exec,exit-status" {
+		t.Fatalf("unexpected requests, got %v", requests)
+	}
+}
+
+func Test_channelCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan context.CancelFunc, 2)
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.Hooks = &Hooks{
+		OnChannelStart: func(_ context.Context, channelType string, cancel context.CancelFunc) {
+			started <- cancel
+		},
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	startCat := func() (*ssh.Session, io.WriteCloser, *lockedBuffer) {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("new ssh session: %v", err)
+		}
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			t.Fatalf("stdin pipe: %v", err)
+		}
+		var stdout lockedBuffer
+		session.Stdout = &stdout
+		if err := session.Start("cat"); err != nil {
+			t.Fatalf("start command: %v", err)
+		}
+		return session, stdin, &stdout
+	}
+	runaway, _, _ := startCat()
+	cancelRunaway := <-started
+	sibling, stdin, stdout := startCat()
+	<-started
+
+	cancelRunaway()
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- runaway.Wait() }()
+	select {
+	case <-waitErr:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected cancelled channel to close")
+	}
+
+	// the sibling channel and the connection are unaffected
+	if _, err := io.WriteString(stdin, "still here"); err != nil {
+		t.Fatalf("write to sibling: %v", err)
+	}
+	stdin.Close()
+	if err := sibling.Wait(); err != nil {
+		t.Fatalf("wait for sibling: %v", err)
+	}
+	if out := stdout.String(); out != "still here" {
+		t.Fatalf("unexpected sibling output: %q", out)
+	}
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("expected connection to remain open: %v", err)
+	}
+}
+
+func Test_serveWithStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	var stats Stats
+	client, serveErr := newServedClient(t, func(serverConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) error {
+		var err error
+		stats, err = proxy.ServeWithStats(ctx, serverConn, chans, reqs)
+		return err
+	})
+	testStdin(t, client)
+	testSessionPipes(t, client)
+	client.Close()
+	<-serveErr
+
+	// "testing\n" is echoed back by cat, and "error\n" is written to stderr
+	expected := Stats{BytesClientToTarget: 8, BytesTargetToClient: 14, StderrBytesTargetToClient: 6}
+	if stats != expected {
+		t.Fatalf("unexpected stats, expected %+v, got %+v", expected, stats)
+	}
+}
+
+func Test_keepAlive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.KeepAlive = 10 * time.Millisecond
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+
+	select {
+	case err := <-serveErr:
+		t.Fatalf("unexpected return from reverse proxy: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	testSessionExec(t, client)
+}
+
+func Test_keepAliveTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a target that never replies to global requests
+	unresponsive := func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go func() {
+			for range reqs {
+			}
+		}()
+		for newCh := range chans {
+			_ = newCh.Reject(ssh.Prohibited, "")
+		}
+	}
+	proxy := New(newTestBackend(t, unresponsive), testClientConfig())
+	proxy.KeepAlive = 10 * time.Millisecond
+	_, serveErr := newProxiedClient(t, ctx, proxy)
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrKeepAliveTimeout) {
+			t.Fatalf("expected ErrKeepAliveTimeout, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after keepalive timeout")
+	}
+}
+
+func Test_idleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.IdleTimeout = 100 * time.Millisecond
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("new stdin pipe: %v", err)
+	}
+	if err := session.Start("cat"); err != nil {
+		t.Fatalf("start command: %v", err)
+	}
+
+	// regular activity, slower than the timeout in total, keeps the session alive
+	for i := 0; i < 10; i++ {
+		if _, err := stdin.Write([]byte("a")); err != nil {
+			t.Fatalf("write stdin: %v", err)
+		}
+		select {
+		case err := <-serveErr:
+			t.Fatalf("unexpected return from reverse proxy: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Fatalf("expected ErrIdleTimeout, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after idle timeout")
+	}
+}
+
+func Test_maxSessionDuration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.MaxSessionDuration = 200 * time.Millisecond
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("new stdin pipe: %v", err)
+	}
+	if err := session.Start("cat"); err != nil {
+		t.Fatalf("start command: %v", err)
+	}
+
+	// activity does not extend the session
+	start := time.Now()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			if _, err := stdin.Write([]byte("a")); err != nil {
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, ErrMaxSessionDuration) {
+			t.Fatalf("expected ErrMaxSessionDuration, got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Fatalf("expected session to last until the max duration, ended after %v", elapsed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after max session duration")
+	}
+	if err := session.Wait(); err == nil {
+		t.Fatalf("expected session to be torn down")
+	}
+}
+
+func Test_channelFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.ChannelFilter = func(_ context.Context, channelType string, extraData []byte) bool {
+		return channelType == "session"
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	_, err := client.Dial("tcp", "127.0.0.1:22")
+	var openChErr *ssh.OpenChannelError
+	if !errors.As(err, &openChErr) {
+		t.Fatalf("expected *ssh.OpenChannelError, got %T: %v", err, err)
+	}
+	if openChErr.Reason != ssh.Prohibited {
+		t.Fatalf("expected ssh.Prohibited, got: %s", openChErr.Reason.String())
+	}
+	testSessionExec(t, client)
+}
+
+func Test_targetChannelFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the backend opens a permitted and a prohibited channel toward the client
+	ready := make(chan struct{})
+	opened := make(chan error, 2)
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go serveSessions(conn, chans, reqs)
+		<-ready
+		for _, channelType := range []string{"allowed@example.com", "forwarded-tcpip"} {
+			ch, chReqs, err := conn.OpenChannel(channelType, nil)
+			if err == nil {
+				go ssh.DiscardRequests(chReqs)
+				ch.Close()
+			}
+			opened <- err
+		}
+		_ = conn.Wait()
+	})
+	proxy := New(backendAddr, testClientConfig())
+	proxy.TargetChannelFilter = func(_ context.Context, channelType string, extraData []byte) bool {
+		return channelType == "allowed@example.com"
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	allowed := client.HandleChannelOpen("allowed@example.com")
+	close(ready)
+	for newCh := range allowed {
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			t.Fatalf("accept channel: %v", err)
+		}
+		go ssh.DiscardRequests(chReqs)
+		ch.Close()
+		break
+	}
+
+	if err := <-opened; err != nil {
+		t.Fatalf("expected permitted channel to be opened, got: %v", err)
+	}
+	var openChErr *ssh.OpenChannelError
+	if err := <-opened; !errors.As(err, &openChErr) || openChErr.Reason != ssh.Prohibited {
+		t.Fatalf("expected prohibited channel to be rejected with ssh.Prohibited, got: %v", err)
+	}
+	testSessionExec(t, client)
+}
+
+func Test_inspectChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	inspected := map[string][]byte{}
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.InspectChannel = func(_ context.Context, channelType string, extraData []byte) error {
+		mu.Lock()
+		inspected[channelType] = append([]byte(nil), extraData...)
+		mu.Unlock()
+		if channelType == "direct-tcpip" {
+			return errors.New("anomalous forwarding request")
+		}
+		return nil
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	extraData := ssh.Marshal(directTCPIPMsg{DestHost: "127.0.0.1", DestPort: 22, OriginHost: "10.0.0.1", OriginPort: 4321})
+	_, _, err := client.OpenChannel("direct-tcpip", extraData)
+	var openChErr *ssh.OpenChannelError
+	if !errors.As(err, &openChErr) {
+		t.Fatalf("expected *ssh.OpenChannelError, got %T: %v", err, err)
+	}
+	if openChErr.Reason != ssh.Prohibited || openChErr.Message != "anomalous forwarding request" {
+		t.Fatalf("expected ssh.Prohibited with the inspector's message, got: %v", openChErr)
+	}
+	testSessionExec(t, client)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !bytes.Equal(inspected["direct-tcpip"], extraData) {
+		t.Fatalf("expected raw extra data %q, got %q", extraData, inspected["direct-tcpip"])
+	}
+	if _, ok := inspected["session"]; !ok {
+		t.Fatalf("expected session channel to be inspected")
+	}
+}
+
+func Test_requestFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.RequestFilter = func(_ context.Context, reqType string, payload []byte) bool {
+		return reqType != "env"
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	if err := session.Setenv("NEW_ENV", "TEST_VALUE"); err == nil {
+		t.Fatalf("expected filtered env request to fail")
+	}
+	output, err := session.CombinedOutput("echo 123")
+	if err != nil {
+		t.Fatalf("execute command: %v", err)
+	}
+	if string(output) != "123\n" {
+		t.Fatalf("unexpected output, expected (%s), got (%s)", "123\n", string(output))
+	}
+}
+
+func Test_globalRequestFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acceptAll := func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go func() {
+			for req := range reqs {
+				_ = req.Reply(true, nil)
+			}
+		}()
+		for newCh := range chans {
+			_ = newCh.Reject(ssh.Prohibited, "")
+		}
+	}
+	proxy := New(newTestBackend(t, acceptAll), testClientConfig())
+	proxy.GlobalRequestFilter = func(_ context.Context, reqType string, payload []byte) bool {
+		return reqType != "blocked"
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	for reqType, expected := range map[string]bool{"allowed": true, "blocked": false} {
+		ok, _, err := client.SendRequest(reqType, true, nil)
+		if err != nil {
+			t.Fatalf("send request: %v", err)
+		}
+		if ok != expected {
+			t.Fatalf("unexpected reply to %q, expected %v, got %v", reqType, expected, ok)
+		}
+	}
+}
+
+func Test_globalRequestReplyPayload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a target that proves its host keys by echoing the request payload
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go func() {
+			for req := range reqs {
+				if req.Type == "hostkeys-prove-00@openssh.com" {
+					_ = req.Reply(true, append([]byte("proof:"), req.Payload...))
+					continue
+				}
+				_ = req.Reply(false, nil)
+			}
+		}()
+		for newCh := range chans {
+			_ = newCh.Reject(ssh.Prohibited, "")
+		}
+	})
+	proxy := New(backendAddr, testClientConfig())
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	ok, payload, err := client.SendRequest("hostkeys-prove-00@openssh.com", true, []byte("keys"))
+	if err != nil {
+		t.Fatalf("send request: %v", err)
+	}
+	if !ok || string(payload) != "proof:keys" {
+		t.Fatalf("expected reply payload to be relayed, got %v %q", ok, payload)
+	}
+}
+
+func Test_channelRequestReply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	client, _ := newProxiedClient(t, ctx, proxy)
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("open channel: %v", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	env := ssh.Marshal(struct{ Key, Value string }{"KEY", "value"})
+	for _, tt := range []struct {
+		reqType  string
+		payload  []byte
+		expected bool
+	}{
+		{"env", env, true},
+		{"unknown", nil, false},
+	} {
+		ok, err := ch.SendRequest(tt.reqType, true, tt.payload)
+		if err != nil {
+			t.Fatalf("send request: %v", err)
+		}
+		if ok != tt.expected {
+			t.Fatalf("unexpected reply to %q, expected %v, got %v", tt.reqType, tt.expected, ok)
+		}
+	}
+}
+
+// wrappedOpenChannelConn wraps errors from opening channels.
+type wrappedOpenChannelConn struct {
+	ssh.Conn
+}
+
+func (c wrappedOpenChannelConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := c.Conn.OpenChannel(name, data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrapped: %w", err)
+	}
+	return ch, reqs, nil
+}
+
+func Test_channelRejectReason(t *testing.T) {
+	reasons := []ssh.RejectionReason{ssh.Prohibited, ssh.ConnectionFailed, ssh.UnknownChannelType, ssh.ResourceShortage}
+	rejectAll := func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			reason, _ := strconv.Atoi(newCh.ChannelType())
+			_ = newCh.Reject(ssh.RejectionReason(reason), "rejected "+newCh.ChannelType())
+		}
+	}
+
+	for _, wrap := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		backendAddr := newTestBackend(t, rejectAll)
+		proxy := New(backendAddr, testClientConfig())
+		if wrap {
+			proxy.DialClient = func(ctx context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+				conn, chans, reqs, err := ssh.NewClientConn(mustDial(t, backendAddr), backendAddr, testClientConfig())
+				return wrappedOpenChannelConn{conn}, chans, reqs, err
+			}
+		}
+		client, _ := newProxiedClient(t, ctx, proxy)
+		for _, reason := range reasons {
+			channelType := strconv.Itoa(int(reason))
+			_, _, err := client.OpenChannel(channelType, nil)
+			var openChanErr *ssh.OpenChannelError
+			if !errors.As(err, &openChanErr) {
+				t.Fatalf("expected *ssh.OpenChannelError, got: %v", err)
+			}
+			if openChanErr.Reason != reason || openChanErr.Message != "rejected "+channelType {
+				t.Fatalf("expected reason %v with message, got %v %q", reason, openChanErr.Reason, openChanErr.Message)
+			}
+		}
+	}
+}
+
+func mustDial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return conn
+}
+
+func Test_clientVersionFilter(t *testing.T) {
+	errVulnerable := errors.New("vulnerable client")
+	var dialed int32
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	proxy.ClientVersionFilter = func(_ context.Context, version string) error {
+		if strings.HasPrefix(version, "SSH-2.0-Vulnerable") {
+			return errVulnerable
+		}
+		return nil
+	}
+
+	for _, tt := range []struct {
+		version  string
+		expected error
+	}{
+		{"SSH-2.0-Vulnerable_1.0", errVulnerable},
+		{"SSH-2.0-Patched_2.0", nil},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		config := testClientConfig()
+		config.ClientVersion = tt.version
+		left, right, err := tcpPipeWithDialer(net.Dial, net.Listen)
+		if err != nil {
+			t.Fatalf("new net pipe: %v", err)
+		}
+		serveErr := make(chan error, 1)
+		go func() {
+			serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+			signer, err := generateSigner()
+			if err != nil {
+				serveErr <- err
+				return
+			}
+			serverConfig.AddHostKey(signer)
+			serverConn, chans, reqs, err := ssh.NewServerConn(right, serverConfig)
+			if err != nil {
+				serveErr <- err
+				return
+			}
+			serveErr <- proxy.Serve(ctx, serverConn, chans, reqs)
+		}()
+		clientConn, chans, reqs, err := ssh.NewClientConn(left, "proxy", config)
+		if err != nil {
+			t.Fatalf("new client conn: %v", err)
+		}
+		client := ssh.NewClient(clientConn, chans, reqs)
+
+		if tt.expected != nil {
+			err := <-serveErr
+			if !errors.Is(err, tt.expected) || !strings.Contains(err.Error(), tt.version) {
+				t.Fatalf("expected error with client version, got: %v", err)
+			}
+			if err := client.Wait(); err == nil {
+				t.Fatalf("expected client connection to be closed")
+			}
+			continue
+		}
+		testSessionExec(t, client)
+		client.Close()
+		<-serveErr
+	}
+	if n := atomic.LoadInt32(&dialed); n != 1 {
+		t.Fatalf("expected only the allowed client to dial the target, got %d dials", n)
+	}
+}
+
+func Test_preferredAlgorithms(t *testing.T) {
+	// a target that only supports a cipher outside the default preferences
+	const cipher = "aes128-cbc"
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.Ciphers = []string{cipher}
+	backendAddr := newTestBackendWithConfig(t, serverConfig, serveSessions)
+
+	proxy := New(backendAddr, testClientConfig())
+	if err := proxy.Serve(context.Background(), nil, nil, nil); err == nil {
+		t.Fatalf("expected handshake with default ciphers to fail")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy.PreferredCiphers = []string{cipher}
+	proxy.PreferredMACs = []string{"hmac-sha2-256"}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+
+	var config ssh.Config
+	proxy.ApplyAlgorithms(&config)
+	if len(config.Ciphers) != 1 || config.Ciphers[0] != cipher || len(config.MACs) != 1 || config.KeyExchanges != nil {
+		t.Fatalf("unexpected applied algorithms: %+v", config)
+	}
+}
+
+func Test_maxChannelsPerConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const limit = 3
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.MaxChannelsPerConn = limit
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	var sessions []*ssh.Session
+	for i := 0; i < limit; i++ {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("new ssh session %d: %v", i, err)
+		}
+		sessions = append(sessions, session)
+	}
+	_, err := client.NewSession()
+	var openChanErr *ssh.OpenChannelError
+	if !errors.As(err, &openChanErr) || openChanErr.Reason != ssh.ResourceShortage {
+		t.Fatalf("expected channel beyond the limit to be rejected, got: %v", err)
+	}
+
+	// closing a channel makes room for another
+	if err := sessions[0].Run("true"); err != nil {
+		t.Fatalf("run command: %v", err)
+	}
+	sessions[0].Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		session, err := client.NewSession()
+		if err == nil {
+			session.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected channel to be accepted after another closed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, session := range sessions[1:] {
+		session.Close()
+	}
+}
+
+func Test_authorizer(t *testing.T) {
+	errDenied := errors.New("denied")
+	var dialed int32
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+
+	for _, allow := range []bool{true, false} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		proxy.Authorizer = func(ctx context.Context, conn *ssh.ServerConn) error {
+			if conn.User() != "test" {
+				t.Errorf("expected authenticated user, got %q", conn.User())
+			}
+			if !allow {
+				return errDenied
+			}
+			return nil
+		}
+		client, serveErr := newProxiedClient(t, ctx, proxy)
+		if allow {
+			testSessionExec(t, client)
+			continue
+		}
+		if err := <-serveErr; !errors.Is(err, errDenied) {
+			t.Fatalf("expected authorizer error, got: %v", err)
+		}
+		if err := client.Wait(); err == nil {
+			t.Fatalf("expected client connection to be closed")
+		}
+	}
+	if n := atomic.LoadInt32(&dialed); n != 1 {
+		t.Fatalf("expected only the authorized client to dial the target, got %d dials", n)
+	}
+}
+
+func Test_targetResolver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, serveSessions)
+	proxy := New("", nil)
+	proxy.TargetResolver = func(ctx context.Context, serverConn *ssh.ServerConn) (string, *ssh.ClientConfig, error) {
+		if serverConn.User() != "test" {
+			return "", nil, fmt.Errorf("unknown user %q", serverConn.User())
+		}
+		return backendAddr, testClientConfig(), nil
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+}
+
+func Test_halfCloseGrace(t *testing.T) {
+	for _, grace := range []time.Duration{0, 3 * time.Second} {
+		// alpha has nothing to receive, while its final burst
+		// to beta arrives shortly after
+		pr, pw := io.Pipe()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = pw.Write([]byte("final"))
+			pw.Close()
+		}()
+		received := &bytes.Buffer{}
+		alpha := memChannel{Reader: pr, Writer: io.Discard, stderr: &bytes.Buffer{}}
+		beta := memChannel{Reader: strings.NewReader(""), Writer: received, stderr: &bytes.Buffer{}}
+
+		c := &proxyConn{proxy: &ReverseProxy{HalfCloseGrace: grace}, logger: printfLogger{}}
+		stats := channelStats{alphaTotal: new(int64), betaTotal: new(int64)}
+		if err := c.bicopy(context.Background(), alpha, beta, &stats); err != nil {
+			t.Fatalf("bicopy: %v", err)
+		}
+		// with a grace period, the final burst must have been copied on return
+		if grace > 0 && received.String() != "final" {
+			t.Fatalf("expected final burst to be copied within grace period, got %q", received.String())
+		}
+		stats.wg.Wait()
+	}
+}
+
+func Test_onConnectDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var connected []ConnInfo
+	disconnected := make(chan ConnInfo, 2)
+	backendAddr := newTestBackend(t, serveSessions)
+	proxy := New(backendAddr, testClientConfig())
+	proxy.OnConnect = func(info ConnInfo) {
+		connected = append(connected, info)
+	}
+	proxy.OnDisconnect = func(info ConnInfo, err error) {
+		if info.Err != err {
+			t.Errorf("expected info.Err to match error, got %v and %v", info.Err, err)
+		}
+		disconnected <- info
+	}
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+	client.Close()
+	err := <-serveErr
+
+	info := <-disconnected
+	if len(connected) != 1 || len(disconnected) != 0 {
+		t.Fatalf("expected callbacks to be called once, got %d and %d", len(connected), len(disconnected)+1)
+	}
+	if info.User != "test" || info.TargetAddr != backendAddr || info.ClientAddr == nil || info.Start != connected[0].Start {
+		t.Fatalf("unexpected connection info: %+v", info)
+	}
+	if info.Duration <= 0 || info.Err != err {
+		t.Fatalf("unexpected disconnect info: %+v", info)
+	}
+}
+
+func Test_onDisconnectHandshakeFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error, got: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	var connects, disconnects int
+	proxy := New(listener.Addr().String(), testClientConfig())
+	proxy.OnConnect = func(ConnInfo) { connects++ }
+	proxy.OnDisconnect = func(info ConnInfo, err error) {
+		disconnects++
+		if err == nil {
+			t.Errorf("expected handshake error")
+		}
+	}
+	if err := proxy.Serve(context.Background(), nil, nil, nil); err == nil {
+		t.Fatalf("expected error from reverse proxy, got: %v", err)
+	}
+	if connects != 1 || disconnects != 1 {
+		t.Fatalf("expected callbacks to be called once, got %d and %d", connects, disconnects)
+	}
+}
+
+func Test_targetServerInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const version = "SSH-2.0-TestBackend"
+	backendAddr := newTestBackendWithConfig(t, &ssh.ServerConfig{NoClientAuth: true, ServerVersion: version}, serveSessions)
+
+	var presented ssh.PublicKey
+	config := testClientConfig()
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		presented = key
+		return nil
+	}
+	disconnected := make(chan ConnInfo, 1)
+	proxy := New(backendAddr, config)
+	proxy.OnDisconnect = func(info ConnInfo, err error) {
+		disconnected <- info
+	}
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+	client.Close()
+	<-serveErr
+
+	info := <-disconnected
+	if info.TargetServerVersion != version {
+		t.Fatalf("expected target server version %q, got %q", version, info.TargetServerVersion)
+	}
+	if presented == nil || info.TargetHostKey == nil || !bytes.Equal(info.TargetHostKey.Marshal(), presented.Marshal()) {
+		t.Fatalf("expected target host key to match the key passed to the host key callback")
+	}
+}
+
+// closeTrackingConn records whether the proxy closed the connection.
+type closeTrackingConn struct {
+	ssh.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeTrackingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func Test_dialClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, serveSessions)
+	var tracked *closeTrackingConn
+	proxy := &ReverseProxy{
+		DialClient: func(ctx context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+			conn, err := net.Dial("tcp", backendAddr)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			destConn, chans, reqs, err := ssh.NewClientConn(conn, backendAddr, testClientConfig())
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			tracked = &closeTrackingConn{Conn: destConn, closed: make(chan struct{})}
+			return tracked, chans, reqs, nil
+		},
+	}
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+	client.Close()
+	<-serveErr
+
+	select {
+	case <-tracked.closed:
+	default:
+		t.Fatalf("expected the target connection to be closed when Serve returns")
+	}
+}
+
+func Test_dialClientError(t *testing.T) {
+	dialErr := errors.New("no pooled connection")
+	proxy := &ReverseProxy{
+		DialClient: func(ctx context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+			return nil, nil, nil, dialErr
+		},
+	}
+	if err := proxy.Serve(context.Background(), nil, nil, nil); !errors.Is(err, dialErr) {
+		t.Fatalf("expected dial client error, got: %v", err)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func Test_shutdownQuiet(t *testing.T) {
+	for _, cancelContext := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var logs lockedBuffer
+		proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+		proxy.ErrorLog = log.New(&logs, "", 0)
+		client, serveErr := newProxiedClient(t, ctx, proxy)
+		testSessionExec(t, client)
+		testStdin(t, client)
+		if cancelContext {
+			cancel()
+		} else {
+			client.Close()
+		}
+		<-serveErr
+		cancel()
+		client.Close()
+
+		if logs.String() != "" {
+			t.Fatalf("expected no errors to be logged during shutdown, got: %s", logs.String())
+		}
+	}
+}
+
+func Test_windowChangeDuringOutput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const changes = 200
+	rows := make(chan uint32, changes)
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ch.Close()
+				for req := range reqs {
+					switch req.Type {
+					case "exec":
+						_ = req.Reply(true, nil)
+						// produce output continuously for the life of the session
+						go func() {
+							chunk := bytes.Repeat([]byte("a"), 1024)
+							for {
+								if _, err := ch.Write(chunk); err != nil {
+									return
+								}
+							}
+						}()
+					case "window-change":
+						var change struct{ Columns, Rows, Width, Height uint32 }
+						if err := ssh.Unmarshal(req.Payload, &change); err == nil {
+							rows <- change.Rows
+						}
+					}
+				}
+			}()
+		}
+	})
+
+	proxy := New(backendAddr, testClientConfig())
+	client, _ := newProxiedClient(t, ctx, proxy)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	session.Stdout = io.Discard
+	if err := session.Start("yes"); err != nil {
+		t.Fatalf("start command: %v", err)
+	}
+
+	for i := 1; i <= changes; i++ {
+		if err := session.WindowChange(i, 80); err != nil {
+			t.Fatalf("window change: %v", err)
+		}
+	}
+	for i := 1; i <= changes; i++ {
+		select {
+		case r := <-rows:
+			if r != uint32(i) {
+				t.Fatalf("expected window changes in order, got %d at %d", r, i)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected %d window changes to be relayed, got %d", changes, i-1)
+		}
+	}
+}
+
+func Test_injectEnv(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.InjectEnv = map[string]string{
+		"SSH_PROXY":      "1",
+		"CORRELATION_ID": "abc123",
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	// the client may override injected variables
+	if err := session.Setenv("CORRELATION_ID", "override"); err != nil {
+		t.Fatalf("set environment variable: %v", err)
+	}
+	output, err := session.Output("echo $SSH_PROXY $CORRELATION_ID")
+	if err != nil {
+		t.Fatalf("run command: %v", err)
+	}
+	if string(output) != "1 override\n" {
+		t.Fatalf("unexpected environment, got %q", output)
+	}
+}
+
+func Test_clientAddrEnv(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.ClientAddrEnv = "SSH_PROXY_CLIENT_ADDR"
+	client, _ := newProxiedClient(t, ctx, proxy)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	output, err := session.Output("echo $SSH_PROXY_CLIENT_ADDR")
+	if err != nil {
+		t.Fatalf("run command: %v", err)
+	}
+	// the proxied client connects from the loopback address
+	if addr := strings.TrimSpace(string(output)); addr != client.LocalAddr().String() {
+		t.Fatalf("expected client address %s, got %q", client.LocalAddr(), addr)
+	}
+}
+
+func Test_injectEnvRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a target that rejects every channel request other than exec
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ch.Close()
+				for req := range reqs {
+					if req.Type != "exec" {
+						_ = req.Reply(false, nil)
+						continue
+					}
+					_ = req.Reply(true, nil)
+					_, _ = ch.Write([]byte("ok"))
+					_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+					return
+				}
+			}()
+		}
+	})
+
+	var logs lockedBuffer
+	proxy := New(backendAddr, testClientConfig())
+	proxy.ErrorLog = log.New(&logs, "", 0)
+	proxy.InjectEnv = map[string]string{"SSH_PROXY": "1"}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	output, err := session.Output("true")
+	if err != nil || string(output) != "ok" {
+		t.Fatalf("expected session to continue after rejected env, got %q: %v", output, err)
+	}
+	if !strings.Contains(logs.String(), "inject env SSH_PROXY") {
+		t.Fatalf("expected rejected env to be logged, got: %s", logs.String())
+	}
+}
+
+func Test_dialRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, serveSessions)
+	var dials int
+	proxy := New(backendAddr, testClientConfig())
+	proxy.DialAttempts = 3
+	proxy.DialBackoff = 10 * time.Millisecond
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		if dials < 3 {
+			return nil, errors.New("connection refused")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+	if dials != 3 {
+		t.Fatalf("expected 3 dial attempts, got %d", dials)
+	}
+}
+
+func Test_dialRetryExhausted(t *testing.T) {
+	var dials int
+	proxy := New("backend", testClientConfig())
+	proxy.DialAttempts = 3
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		return nil, fmt.Errorf("attempt %d failed", dials)
+	}
+	err := proxy.Serve(context.Background(), nil, nil, nil)
+	if err == nil || err.Error() != "dial reverse proxy target: attempt 3 failed" {
+		t.Fatalf("expected last dial error, got: %v", err)
+	}
+}
+
+func Test_dialRetryAuthFailure(t *testing.T) {
+	backendAddr := newTestBackendWithConfig(t, &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("permission denied")
+		},
+	}, serveSessions)
+
+	var dials int
+	config := testClientConfig()
+	config.Auth = []ssh.AuthMethod{ssh.Password("incorrect")}
+	proxy := New(backendAddr, config)
+	proxy.DialAttempts = 3
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	if err := proxy.Serve(context.Background(), nil, nil, nil); err == nil {
+		t.Fatalf("expected authentication error from reverse proxy")
+	}
+	if dials != 1 {
+		t.Fatalf("expected authentication failure not to be retried, got %d dials", dials)
+	}
+}
+
+func Test_dialRetryHostKeyFailure(t *testing.T) {
+	backendAddr := newTestBackend(t, serveSessions)
+
+	errUnknownKey := errors.New("unknown host key")
+	var dials int
+	config := testClientConfig()
+	config.HostKeyCallback = func(string, net.Addr, ssh.PublicKey) error {
+		return errUnknownKey
+	}
+	proxy := New(backendAddr, config)
+	proxy.DialAttempts = 3
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	err := proxy.Serve(context.Background(), nil, nil, nil)
+	if !errors.Is(err, ErrBackendHostKey) || !errors.Is(err, errUnknownKey) || errors.Is(err, ErrBackendDial) {
+		t.Fatalf("expected ErrBackendHostKey wrapping the callback error, got: %v", err)
+	}
+	if dials != 1 {
+		t.Fatalf("expected host key failure not to be retried, got %d dials", dials)
+	}
+}
+
+func Test_connectErrorClass(t *testing.T) {
+	authBackend := newTestBackendWithConfig(t, &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("permission denied")
+		},
+	}, serveSessions)
+	authConfig := testClientConfig()
+	authConfig.Auth = []ssh.AuthMethod{ssh.Password("incorrect")}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name     string
+		proxy    *ReverseProxy
+		expected error
+		other    error
+	}{
+		{"auth", New(authBackend, authConfig), ErrBackendAuth, ErrBackendDial},
+		{"no_methods", New(newTestBackendWithConfig(t, &ssh.ServerConfig{
+			PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+				return nil, errors.New("permission denied")
+			},
+		}, serveSessions), testClientConfig()), ErrBackendAuth, ErrBackendDial},
+		{"dial", New(closedAddr, testClientConfig()), ErrBackendDial, ErrBackendAuth},
+		{"dial_client", &ReverseProxy{DialClient: func(context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+			return nil, nil, nil, errors.New("connection refused")
+		}}, ErrBackendDial, ErrBackendAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.proxy.Serve(context.Background(), nil, nil, nil)
+			if !errors.Is(err, tt.expected) || errors.Is(err, tt.other) {
+				t.Fatalf("expected %v, got: %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func Test_backendAuthMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackendWithConfig(t, &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("permission denied")
+		},
+	}, serveSessions)
+	config := testClientConfig()
+	config.Auth = []ssh.AuthMethod{ssh.Password("incorrect")}
+	proxy := New(backendAddr, config)
+	proxy.BackendAuthMessage = "target refused credentials"
+	client, serveErr := newProxiedClient(t, ctx, proxy)
+
+	_, err := client.NewSession()
+	if err == nil || !strings.Contains(err.Error(), "target refused credentials") {
+		t.Fatalf("expected channel rejection with auth message, got: %v", err)
+	}
+	if err := <-serveErr; !errors.Is(err, ErrBackendAuth) {
+		t.Fatalf("expected ErrBackendAuth, got: %v", err)
+	}
+}
+
+func Test_dialRetryContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New("backend", testClientConfig())
+	proxy.DialAttempts = 3
+	proxy.DialBackoff = time.Hour
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		cancel()
+		return nil, errors.New("connection refused")
+	}
+	if err := proxy.Serve(ctx, nil, nil, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func Test_agentForwarding(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		allow := !disable
+		t.Run(fmt.Sprintf("disable_%v", disable), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// the backend opens an agent channel toward the client for each
+			// session, and expects a reply to its ping
+			agentResult := make(chan error, 1)
+			agentBackend := func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+				go ssh.DiscardRequests(reqs)
+				for newCh := range chans {
+					ch, chReqs, err := newCh.Accept()
+					if err != nil {
+						return
+					}
+					defer ch.Close()
+					go func() {
+						for req := range chReqs {
+							_ = req.Reply(req.Type == "auth-agent-req@openssh.com", nil)
+						}
+					}()
+					go func() { agentResult <- pingAgent(conn) }()
+				}
+			}
+
+			proxy := New(newTestBackend(t, agentBackend), testClientConfig())
+			proxy.DisableAgentForwarding = disable
+			client, _ := newProxiedClient(t, ctx, proxy)
+
+			go func() {
+				for newCh := range client.HandleChannelOpen("auth-agent@openssh.com") {
+					ch, reqs, err := newCh.Accept()
+					if err != nil {
+						return
+					}
+					go ssh.DiscardRequests(reqs)
+					_, _ = io.ReadFull(ch, make([]byte, 4))
+					_, _ = ch.Write([]byte("pong"))
+					ch.Close()
+				}
+			}()
+
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatalf("new ssh session: %v", err)
+			}
+			defer session.Close()
+			ok, err := session.SendRequest("auth-agent-req@openssh.com", true, nil)
+			if err != nil {
+				t.Fatalf("send agent request: %v", err)
+			}
+			if ok != allow {
+				t.Fatalf("unexpected reply to agent request, expected %v, got %v", allow, ok)
+			}
+
+			err = <-agentResult
+			if allow && err != nil {
+				t.Fatalf("expected agent channel to be relayed: %v", err)
+			}
+			var openChErr *ssh.OpenChannelError
+			if !allow && (!errors.As(err, &openChErr) || openChErr.Reason != ssh.Prohibited) {
+				t.Fatalf("expected agent channel to be prohibited, got: %v", err)
+			}
+		})
+	}
+}
+
+// pingAgent opens an agent channel toward the client of conn,
+// and verifies that it replies to a ping.
+func pingAgent(conn ssh.Conn) error {
+	ch, reqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	if _, err := ch.Write([]byte("ping")); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(ch, reply); err != nil {
+		return err
+	}
+	if string(reply) != "pong" {
+		return fmt.Errorf("unexpected agent reply %q", reply)
+	}
+	return nil
+}
+
+// stuckChannel is an ssh.Channel whose writes block until it is closed.
+type stuckChannel struct {
+	memChannel
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (s *stuckChannel) Write([]byte) (int, error) {
+	<-s.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (s *stuckChannel) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func Test_writeTimeout(t *testing.T) {
+	w := &stuckChannel{memChannel: memChannel{stderr: &bytes.Buffer{}}, closed: make(chan struct{})}
+	r := memChannel{Reader: strings.NewReader("data"), stderr: &bytes.Buffer{}}
+
+	c := &proxyConn{proxy: &ReverseProxy{WriteTimeout: 50 * time.Millisecond}, logger: printfLogger{}}
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		c.copyChannels(w, r, new(int64), new(int64))
+	}()
+
+	select {
+	case <-copied:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected stalled write to be aborted")
+	}
+	select {
+	case <-w.closed:
+	default:
+		t.Fatalf("expected stalled channel to be closed")
+	}
+}
+
+func Test_copiesStderr(t *testing.T) {
+	tests := []struct {
+		skip        []string
+		channelType string
+		expected    bool
+	}{
+		{nil, "session", true},
+		{nil, "direct-tcpip", false},
+		{nil, "auth-agent@openssh.com", false},
+		{[]string{}, "direct-tcpip", true},
+		{[]string{"session"}, "session", false},
+		{[]string{"session"}, "direct-tcpip", true},
+	}
+	for _, tt := range tests {
+		proxy := &ReverseProxy{NoStderrChannelTypes: tt.skip}
+		if got := proxy.copiesStderr(tt.channelType); got != tt.expected {
+			t.Errorf("copiesStderr(%q) with %q: expected %v, got %v", tt.channelType, tt.skip, tt.expected, got)
+		}
+	}
+}
+
+func Test_copyChannelsNoStderr(t *testing.T) {
+	w := memChannel{Writer: &bytes.Buffer{}}
+	r := memChannel{Reader: strings.NewReader("data")}
+
+	// memChannel panics on a nil stderr if it is copied
+	c := &proxyConn{proxy: &ReverseProxy{}, logger: printfLogger{}}
+	var total int64
+	if n := c.copyChannels(w, r, &total, nil); n != 4 || total != 4 {
+		t.Fatalf("expected 4 bytes copied, got %d and %d", n, total)
+	}
+}
+
+// BenchmarkCopyChannelsGoroutines reports the goroutines used by each copy of
+// an idle forwarding channel, with and without copying its stderr stream.
+func BenchmarkCopyChannelsGoroutines(b *testing.B) {
+	const channels = 100
+	for name, skip := range map[string]bool{"copy_stderr": false, "skip_stderr": true} {
+		b.Run(name, func(b *testing.B) {
+			c := &proxyConn{proxy: &ReverseProxy{}, logger: printfLogger{}}
+			var perChannel float64
+			for i := 0; i < b.N; i++ {
+				before := runtime.NumGoroutine()
+				var wg sync.WaitGroup
+				var pipes []*io.PipeWriter
+				for j := 0; j < channels; j++ {
+					primaryR, primaryW := io.Pipe()
+					stderrR, stderrW := io.Pipe()
+					pipes = append(pipes, primaryW, stderrW)
+					w := memChannel{Writer: io.Discard, stderr: &bytes.Buffer{}}
+					r := memChannel{Reader: primaryR, stderr: struct {
+						io.Reader
+						io.Writer
+					}{stderrR, io.Discard}}
+					var stderrTotal *int64
+					if !skip {
+						stderrTotal = new(int64)
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						c.copyChannels(w, r, new(int64), stderrTotal)
+					}()
+				}
+				// let the copies block on their reads
+				time.Sleep(10 * time.Millisecond)
+				perChannel = float64(runtime.NumGoroutine()-before) / channels
+				for _, p := range pipes {
+					p.Close()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(perChannel, "goroutines/channel")
+		})
+	}
+}
+
 func generateSigner() (ssh.Signer, error) {
 	const blockType = "EC PRIVATE KEY"
 	pkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -0,0 +1,265 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SharedBackend shares a single SSH connection to each target between
+// proxied connections, for targets that are expensive to authenticate with.
+// Each proxied connection opens its channels on the shared connection, which
+// is closed when the last proxied connection using it is closed, and dialed
+// again by the next one if it terminates.
+//
+// Channels opened by a shared target, such as for remote port forwarding or
+// agent forwarding, cannot be attributed to a single client, and are
+// rejected. Likewise, global requests sent by the target are discarded, and
+// global requests sent by a client that would affect the whole connection,
+// such as "tcpip-forward" or "no-more-sessions@openssh.com", are replied to
+// with failure rather than being relayed.
+//
+// The zero value is ready to use. A SharedBackend must not be copied after
+// first use.
+type SharedBackend struct {
+	// Dial optionally specifies the function used to connect to targets, as
+	// ReverseProxy.Dial. If nil, a net.Dialer with the Timeout of the client
+	// config is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu    sync.Mutex
+	conns map[sharedKey]*sharedConn
+}
+
+// sharedKey identifies the connections that may be shared.
+type sharedKey struct {
+	addr   string
+	config *ssh.ClientConfig
+}
+
+// sharedConn is a reference counted connection to a target.
+type sharedConn struct {
+	ssh.Conn
+	refs    int                // guarded by SharedBackend.mu
+	cancel  context.CancelFunc // aborts the dial once unreferenced
+	ready   chan struct{}      // closed once the dial completes
+	err     error              // the dial error, set before ready is closed
+	done    chan struct{}      // closed once the connection terminates
+	waitErr error              // set before done is closed
+}
+
+// DialClient returns a function, suitable for ReverseProxy.DialClient, that
+// returns a lease on the shared connection to addr authenticated with config,
+// establishing it if necessary. Connections are only shared between functions
+// returned for the same address and *ssh.ClientConfig, such that differing
+// credentials are never mixed.
+func (b *SharedBackend) DialClient(addr string, config *ssh.ClientConfig) func(ctx context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	key := sharedKey{addr: addr, config: config}
+	return func(ctx context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+		shared, err := b.acquire(ctx, key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		lease := &sharedLease{Conn: shared.Conn, backend: b, key: key, shared: shared, closed: make(chan struct{})}
+		chans := make(chan ssh.NewChannel)
+		reqs := make(chan *ssh.Request)
+		go func() {
+			select {
+			case <-lease.closed:
+			case <-shared.done:
+			}
+			close(chans)
+			close(reqs)
+		}()
+		return lease, chans, reqs, nil
+	}
+}
+
+// acquire returns the shared connection for key, dialing it if there is
+// none, and holding a reference to it until released. The dial is not bound
+// to ctx, such that a caller giving up does not fail the others waiting for
+// the same connection, but is aborted once every caller has given up.
+func (b *SharedBackend) acquire(ctx context.Context, key sharedKey) (*sharedConn, error) {
+	b.mu.Lock()
+	if b.conns == nil {
+		b.conns = make(map[sharedKey]*sharedConn)
+	}
+	shared, ok := b.conns[key]
+	if !ok {
+		dialCtx, cancel := context.WithCancel(context.Background())
+		shared = &sharedConn{cancel: cancel, ready: make(chan struct{}), done: make(chan struct{})}
+		b.conns[key] = shared
+		go b.dialShared(dialCtx, key, shared)
+	}
+	shared.refs++
+	b.mu.Unlock()
+
+	select {
+	case <-shared.ready:
+	case <-ctx.Done():
+		b.release(key, shared)
+		return nil, ctx.Err()
+	}
+	if shared.err != nil {
+		b.release(key, shared)
+		return nil, shared.err
+	}
+	return shared, nil
+}
+
+// dialShared dials the connection for shared, closing it if every caller
+// gave up while it was being dialed.
+func (b *SharedBackend) dialShared(ctx context.Context, key sharedKey, shared *sharedConn) {
+	shared.err = b.connect(ctx, key, shared)
+	close(shared.ready)
+
+	b.mu.Lock()
+	unreferenced := shared.refs == 0
+	b.mu.Unlock()
+	if unreferenced && shared.err == nil {
+		shared.Conn.Close()
+	}
+}
+
+// release drops a reference to shared, closing it once unreferenced, or
+// aborting its dial if still pending.
+func (b *SharedBackend) release(key sharedKey, shared *sharedConn) {
+	b.mu.Lock()
+	shared.refs--
+	last := shared.refs == 0
+	if last && b.conns[key] == shared {
+		delete(b.conns, key)
+	}
+	b.mu.Unlock()
+	if !last {
+		return
+	}
+	shared.cancel()
+	select {
+	case <-shared.ready:
+		if shared.err == nil {
+			shared.Conn.Close()
+		}
+	default:
+		// closed by dialShared once the dial completes
+	}
+}
+
+// connect dials the target for key into shared, removing shared from the
+// backend when the dial fails or the connection later terminates.
+func (b *SharedBackend) connect(ctx context.Context, key sharedKey, shared *sharedConn) error {
+	forget := func() {
+		b.mu.Lock()
+		if b.conns[key] == shared {
+			delete(b.conns, key)
+		}
+		b.mu.Unlock()
+	}
+
+	conn, chans, reqs, err := b.dial(ctx, key)
+	if err != nil {
+		forget()
+		return err
+	}
+	shared.Conn = conn
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for newChannel := range chans {
+			_ = newChannel.Reject(ssh.Prohibited, "channels from a shared target are not supported")
+		}
+	}()
+	go func() {
+		shared.waitErr = conn.Wait()
+		forget()
+		close(shared.done)
+	}()
+	return nil
+}
+
+func (b *SharedBackend) dial(ctx context.Context, key sharedKey) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	var conn net.Conn
+	var err error
+	if b.Dial != nil {
+		conn, err = b.Dial(ctx, "tcp", key.addr)
+	} else {
+		dialer := net.Dialer{Timeout: key.config.Timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", key.addr)
+	}
+	if err != nil {
+		return nil, nil, nil, newConnectError(fmt.Errorf("dial shared target: %w", err))
+	}
+
+	// bound the handshake by the context
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-handshakeDone:
+		}
+	}()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, key.addr, key.config)
+	close(handshakeDone)
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, nil, nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, newConnectError(fmt.Errorf("shared target ssh client conn: %w", err))
+	}
+	return sshConn, chans, reqs, nil
+}
+
+// connectionScopedRequests are the global requests whose effect outlasts the
+// request and applies to the whole connection, such that they must not be
+// relayed to a shared connection on behalf of one client.
+var connectionScopedRequests = map[string]bool{
+	"no-more-sessions@openssh.com":           true,
+	tcpipForwardRequestType:                  true,
+	cancelTCPIPForwardRequestType:            true,
+	"streamlocal-forward@openssh.com":        true,
+	"cancel-streamlocal-forward@openssh.com": true,
+}
+
+// sharedLease is the ssh.Conn returned to a single proxied connection, whose
+// Close releases the shared connection rather than closing it.
+type sharedLease struct {
+	ssh.Conn
+	backend *SharedBackend
+	key     sharedKey
+	shared  *sharedConn
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func (l *sharedLease) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.backend.release(l.key, l.shared)
+	})
+	return nil
+}
+
+// SendRequest sends global requests on the shared connection, other than
+// connectionScopedRequests, which fail without being sent.
+func (l *sharedLease) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	if connectionScopedRequests[name] {
+		return false, nil, nil
+	}
+	return l.Conn.SendRequest(name, wantReply, payload)
+}
+
+// Wait returns once the lease is closed, or the shared connection terminates.
+func (l *sharedLease) Wait() error {
+	select {
+	case <-l.closed:
+		return nil
+	case <-l.shared.done:
+		return l.shared.waitErr
+	}
+}
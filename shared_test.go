@@ -0,0 +1,226 @@
+package sshproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_sharedBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var conns, closed int32
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		atomic.AddInt32(&conns, 1)
+		serveSessions(conn, chans, reqs)
+		atomic.AddInt32(&closed, 1)
+	})
+
+	var backend SharedBackend
+	config := testClientConfig()
+	newClient := func() (*ssh.Client, <-chan error) {
+		proxy := New(backendAddr, config)
+		proxy.DialClient = backend.DialClient(backendAddr, config)
+		return newProxiedClient(t, ctx, proxy)
+	}
+
+	first, firstErr := newClient()
+	second, secondErr := newClient()
+	testSessionExec(t, first)
+	testSessionExec(t, second)
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("expected 1 shared backend connection, got %d", n)
+	}
+
+	first.Close()
+	<-firstErr
+	testSessionExec(t, second)
+	if n := atomic.LoadInt32(&closed); n != 0 {
+		t.Fatalf("expected shared backend connection to outlive the first client")
+	}
+
+	second.Close()
+	<-secondErr
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt32(&closed) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected shared backend connection to close with the last client")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the next client dials a new connection
+	third, _ := newClient()
+	testSessionExec(t, third)
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Fatalf("expected the backend to be dialed again, got %d connections", n)
+	}
+}
+
+func Test_sharedBackendTargetClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var conns int32
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		if atomic.AddInt32(&conns, 1) == 1 {
+			// the first connection dies shortly after the handshake
+			go ssh.DiscardRequests(reqs)
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		serveSessions(conn, chans, reqs)
+	})
+
+	var backend SharedBackend
+	config := testClientConfig()
+	proxy := New(backendAddr, config)
+	proxy.DialClient = backend.DialClient(backendAddr, config)
+
+	_, serveErr := newProxiedClient(t, ctx, proxy)
+	select {
+	case <-serveErr:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected reverse proxy to return after the shared connection closed")
+	}
+
+	client, _ := newProxiedClient(t, ctx, proxy)
+	testSessionExec(t, client)
+}
+
+func Test_sharedBackendGlobalRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the backend records the global requests it receives, and like
+	// OpenSSH, refuses new sessions after "no-more-sessions@openssh.com"
+	received := make(chan string, 8)
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		var noMoreSessions int32
+		go func() {
+			for req := range reqs {
+				received <- req.Type
+				if req.Type == "no-more-sessions@openssh.com" {
+					atomic.StoreInt32(&noMoreSessions, 1)
+				}
+				_ = req.Reply(req.Type == tcpipForwardRequestType, nil)
+			}
+		}()
+		for newCh := range chans {
+			if atomic.LoadInt32(&noMoreSessions) == 1 {
+				_ = newCh.Reject(ssh.Prohibited, "no more sessions")
+				continue
+			}
+			go serveSession(newCh)
+		}
+	})
+
+	var backend SharedBackend
+	config := testClientConfig()
+	newClient := func() *ssh.Client {
+		proxy := New(backendAddr, config)
+		proxy.DialClient = backend.DialClient(backendAddr, config)
+		client, _ := newProxiedClient(t, ctx, proxy)
+		return client
+	}
+	first, second := newClient(), newClient()
+
+	for _, reqType := range []string{"no-more-sessions@openssh.com", tcpipForwardRequestType, cancelTCPIPForwardRequestType} {
+		ok, _, err := first.SendRequest(reqType, true, ssh.Marshal(tcpipForwardMsg{BindAddr: "127.0.0.1", BindPort: 0}))
+		if err != nil {
+			t.Fatalf("send %s: %v", reqType, err)
+		}
+		if ok {
+			t.Fatalf("expected %s to fail on a shared connection", reqType)
+		}
+	}
+	testSessionExec(t, second)
+
+	// a request that is not connection-scoped is still relayed
+	if _, _, err := first.SendRequest("example@example.com", true, nil); err != nil {
+		t.Fatalf("send global request: %v", err)
+	}
+	select {
+	case reqType := <-received:
+		if reqType != "example@example.com" {
+			t.Fatalf("expected only the unscoped request to be relayed, got %s", reqType)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected unscoped request to be relayed")
+	}
+}
+
+func Test_sharedBackendDialCancel(t *testing.T) {
+	backendAddr := newTestBackend(t, serveSessions)
+
+	// the dial blocks until both callers are waiting for it
+	dialing, proceed := make(chan struct{}), make(chan struct{})
+	backend := &SharedBackend{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			close(dialing)
+			<-proceed
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	config := testClientConfig()
+	dial := backend.DialClient(backendAddr, config)
+	key := sharedKey{addr: backendAddr, config: config}
+	refs := func() int {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		if shared, ok := backend.conns[key]; ok {
+			return shared.refs
+		}
+		return 0
+	}
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, _, _, err := dial(firstCtx)
+		firstErr <- err
+	}()
+	<-dialing
+
+	type result struct {
+		conn ssh.Conn
+		err  error
+	}
+	second := make(chan result, 1)
+	go func() {
+		conn, _, _, err := dial(context.Background())
+		second <- result{conn, err}
+	}()
+	deadline := time.Now().Add(3 * time.Second)
+	for refs() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both callers to wait for the dial")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the first caller gives up, while the second is still served
+	cancelFirst()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the first caller to be canceled, got: %v", err)
+	}
+	close(proceed)
+	res := <-second
+	if res.err != nil {
+		t.Fatalf("expected the second caller to be connected, got: %v", res.err)
+	}
+	defer res.conn.Close()
+	ch, reqs, err := res.conn.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("open session on shared connection: %v", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	ch.Close()
+}
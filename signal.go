@@ -0,0 +1,41 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const signalRequestType = "signal"
+
+// signalRequest is the payload of a "signal" channel request,
+// as described in RFC 4254, section 6.9.
+type signalRequest struct {
+	Signal string
+}
+
+// ParseSignalRequest decodes the payload of a "signal" request, returning
+// the name of the signal without the "SIG" prefix, such as "INT".
+func ParseSignalRequest(payload []byte) (string, error) {
+	var req signalRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return "", fmt.Errorf("parse signal payload: %w", err)
+	}
+	return req.Signal, nil
+}
+
+// allowSignal reports whether the "signal" request with the given payload is
+// allowed by SignalFilter, logging blocked signals. Malformed payloads are
+// rejected.
+func (c *proxyConn) allowSignal(ctx context.Context, payload []byte) bool {
+	sig, err := ParseSignalRequest(payload)
+	if err != nil {
+		return false
+	}
+	if !c.proxy.SignalFilter(ctx, sig) {
+		c.logger.Info("sshproxy: ReverseProxy block signal %s", sig)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package sshproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_parseSignalRequest(t *testing.T) {
+	sig, err := ParseSignalRequest(ssh.Marshal(signalRequest{Signal: "INT"}))
+	if err != nil || sig != "INT" {
+		t.Fatalf("expected INT, got %q: %v", sig, err)
+	}
+	if _, err := ParseSignalRequest([]byte("invalid")); err == nil {
+		t.Fatalf("expected error parsing invalid payload")
+	}
+}
+
+func Test_signalFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the backend reports each signal it receives
+	signals := make(chan string, 2)
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			defer ch.Close()
+			go func() {
+				for req := range reqs {
+					if req.Type == signalRequestType {
+						sig, _ := ParseSignalRequest(req.Payload)
+						signals <- sig
+					}
+					_ = req.Reply(true, nil)
+				}
+			}()
+		}
+	})
+	proxy := New(backendAddr, testClientConfig())
+	proxy.SignalFilter = func(_ context.Context, sig string) bool {
+		return sig != "KILL"
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("open session channel: %v", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for sig, allowed := range map[string]bool{"KILL": false, "INT": true} {
+		ok, err := ch.SendRequest(signalRequestType, true, ssh.Marshal(signalRequest{Signal: sig}))
+		if err != nil {
+			t.Fatalf("send %s signal: %v", sig, err)
+		}
+		if ok != allowed {
+			t.Fatalf("expected %s signal allowed to be %v, got %v", sig, allowed, ok)
+		}
+	}
+
+	select {
+	case sig := <-signals:
+		if sig != "INT" {
+			t.Fatalf("expected only INT to reach the backend, got %s", sig)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected INT to reach the backend")
+	}
+	select {
+	case sig := <-signals:
+		t.Fatalf("expected blocked signal not to reach the backend, got %s", sig)
+	default:
+	}
+}
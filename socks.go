@@ -0,0 +1,55 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// SOCKSProxyError is returned by the function from SOCKS5Dialer when the
+// SOCKS server itself cannot be reached. Errors from the SOCKS server, such
+// as failing to connect to the target, are returned as other errors.
+type SOCKSProxyError struct {
+	Addr string
+	Err  error
+}
+
+func (e *SOCKSProxyError) Error() string {
+	return fmt.Sprintf("sshproxy: dial socks proxy %s: %v", e.Addr, e.Err)
+}
+
+func (e *SOCKSProxyError) Unwrap() error { return e.Err }
+
+// SOCKS5Dialer returns a function, suitable for ReverseProxy.Dial, that
+// connects to the target through the SOCKS5 server at socksAddr. The auth may
+// be nil if the server does not require username and password authentication.
+// For example:
+//
+//	rp := sshproxy.New(targetAddr, config)
+//	rp.Dial = sshproxy.SOCKS5Dialer("socks.internal:1080", &proxy.Auth{User: user, Password: password})
+func SOCKS5Dialer(socksAddr string, auth *proxy.Auth) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	forward := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, &SOCKSProxyError{Addr: addr, Err: err}
+		}
+		return conn, nil
+	})
+	// SOCKS5 does not return an error, and its dialer supports contexts
+	dialer, _ := proxy.SOCKS5("tcp", socksAddr, auth, forward)
+	return dialer.(proxy.ContextDialer).DialContext
+}
+
+// dialerFunc implements proxy.ContextDialer with a function.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
@@ -0,0 +1,166 @@
+package sshproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// newTestSOCKS5Server starts a minimal SOCKS5 server supporting username and
+// password authentication and the CONNECT command, returning its address.
+func newTestSOCKS5Server(t *testing.T, user, password string, connects *int32) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				target, err := socks5Handshake(conn, user, password)
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(connects, 1)
+				dest, err := net.Dial("tcp", target)
+				if err != nil {
+					// general failure
+					_, _ = conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer dest.Close()
+				_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go func() {
+					_, _ = io.Copy(dest, conn)
+				}()
+				_, _ = io.Copy(conn, dest)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// socks5Handshake authenticates the client and returns the requested target.
+func socks5Handshake(conn net.Conn, user, password string) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return "", err
+	}
+	// username and password authentication
+	if _, err := conn.Write([]byte{5, 2}); err != nil {
+		return "", err
+	}
+	readString := func() (string, error) {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		s := make([]byte, length[0])
+		_, err := io.ReadFull(conn, s)
+		return string(s), err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		return "", err
+	}
+	gotUser, err := readString()
+	if err != nil {
+		return "", err
+	}
+	gotPassword, err := readString()
+	if err != nil {
+		return "", err
+	}
+	if gotUser != user || gotPassword != password {
+		_, _ = conn.Write([]byte{1, 1})
+		return "", errors.New("authentication failed")
+	}
+	if _, err := conn.Write([]byte{1, 0}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		if host, err = readString(); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("unsupported address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func Test_socks5Dialer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var connects int32
+	socksAddr := newTestSOCKS5Server(t, "user", "secret", &connects)
+
+	rp := New(newTestBackend(t, serveSessions), testClientConfig())
+	rp.Dial = SOCKS5Dialer(socksAddr, &proxy.Auth{User: "user", Password: "secret"})
+	client, _ := newProxiedClient(t, ctx, rp)
+	testSessionExec(t, client)
+
+	if n := atomic.LoadInt32(&connects); n != 1 {
+		t.Fatalf("expected 1 connection through the socks proxy, got %d", n)
+	}
+}
+
+func Test_socks5DialerErrors(t *testing.T) {
+	var connects int32
+	socksAddr := newTestSOCKS5Server(t, "user", "secret", &connects)
+
+	// an unreachable socks server is distinguishable
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	dial := SOCKS5Dialer(closedAddr, nil)
+	_, err = dial(context.Background(), "tcp", "127.0.0.1:22")
+	var proxyErr *SOCKSProxyError
+	if !errors.As(err, &proxyErr) || proxyErr.Addr != closedAddr {
+		t.Fatalf("expected *SOCKSProxyError, got: %v", err)
+	}
+
+	// an unreachable target is not a socks server error
+	dial = SOCKS5Dialer(socksAddr, &proxy.Auth{User: "user", Password: "secret"})
+	_, err = dial(context.Background(), "tcp", closedAddr)
+	if err == nil || errors.As(err, &proxyErr) {
+		t.Fatalf("expected target dial error, got: %v", err)
+	}
+}
@@ -3,17 +3,20 @@ package sshproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -294,3 +297,317 @@ func netPipeWithDialer(dial dialer, listen listener, net, addr string) (net.Conn
 
 	return c1, c2, nil
 }
+
+// backendHandler serves a single SSH connection accepted by a test backend.
+type backendHandler func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request)
+
+// newTestBackend starts an in-process SSH server to act as a reverse proxy
+// target, returning its address. Each accepted connection is served by handle.
+func newTestBackend(t *testing.T, handle backendHandler) string {
+	t.Helper()
+	return newTestBackendWithConfig(t, &ssh.ServerConfig{NoClientAuth: true}, handle)
+}
+
+// newTestBackendWithConfig is like newTestBackend, but uses the given server
+// config, to which a generated host key is added.
+func newTestBackendWithConfig(t *testing.T, config *ssh.ServerConfig, handle backendHandler) string {
+	t.Helper()
+	signer, err := generateSigner()
+	if err != nil {
+		t.Fatalf("generate signer: %v", err)
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				defer serverConn.Close()
+				handle(serverConn, chans, reqs)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serveSessions is a backendHandler implementing a small subset of a real SSH
+// server: "session" channels supporting "env" and "exec" via /bin/sh, and
+// "direct-tcpip" forwarding. Global requests are rejected.
+func serveSessions(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			go serveSession(newCh)
+		case "direct-tcpip":
+			go serveDirectTCPIP(newCh)
+		default:
+			_ = newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+func serveSession(newCh ssh.NewChannel) {
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	var env []string
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var kv struct{ Key, Value string }
+			if err := ssh.Unmarshal(req.Payload, &kv); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			env = append(env, kv.Key+"="+kv.Value)
+			_ = req.Reply(true, nil)
+		case "exec":
+			var cmd struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &cmd); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+
+			c := exec.Command("/bin/sh", "-c", cmd.Command)
+			c.Env = env
+			c.Stdout, c.Stderr = ch, ch.Stderr()
+			stdin, _ := c.StdinPipe()
+			go func() {
+				_, _ = io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+			var status struct{ Status uint32 }
+			if err := c.Run(); err != nil {
+				status.Status = 255
+				var exitErr *exec.ExitError
+				if errors.As(err, &exitErr) {
+					status.Status = uint32(exitErr.ExitCode())
+				}
+			}
+			_ = ch.CloseWrite()
+			_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+			return
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func serveDirectTCPIP(newCh ssh.NewChannel) {
+	var dest struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newCh.ExtraData(), &dest); err != nil {
+		_ = newCh.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))))
+	if err != nil {
+		_ = newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(conn, ch)
+	}()
+	_, _ = io.Copy(ch, conn)
+	_ = ch.CloseWrite()
+	<-done
+}
+
+// serveOpenSSH is a backendHandler extending serveSessions with the remote
+// port forwarding of "tcpip-forward" requests, and rejecting unknown channel
+// types with ssh.ConnectionFailed like OpenSSH, such that testSSHClient may
+// run without an external server.
+func serveOpenSSH(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	var mu sync.Mutex
+	listeners := make(map[string]net.Listener)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	go func() {
+		for req := range reqs {
+			var msg tcpipForwardMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			switch req.Type {
+			case tcpipForwardRequestType:
+				l, err := net.Listen("tcp", net.JoinHostPort(msg.BindAddr, strconv.Itoa(int(msg.BindPort))))
+				if err != nil {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				port := uint32(l.Addr().(*net.TCPAddr).Port)
+				mu.Lock()
+				listeners[net.JoinHostPort(msg.BindAddr, strconv.Itoa(int(port)))] = l
+				mu.Unlock()
+				var reply []byte
+				if msg.BindPort == 0 {
+					reply = ssh.Marshal(tcpipForwardReply{Port: port})
+				}
+				_ = req.Reply(true, reply)
+				go serveRemoteForward(conn, l, msg.BindAddr, port)
+			case cancelTCPIPForwardRequestType:
+				key := net.JoinHostPort(msg.BindAddr, strconv.Itoa(int(msg.BindPort)))
+				mu.Lock()
+				l, ok := listeners[key]
+				delete(listeners, key)
+				mu.Unlock()
+				if ok {
+					l.Close()
+				}
+				_ = req.Reply(ok, nil)
+			default:
+				_ = req.Reply(false, nil)
+			}
+		}
+	}()
+
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			go serveSession(newCh)
+		case "direct-tcpip":
+			go serveDirectTCPIP(newCh)
+		default:
+			_ = newCh.Reject(ssh.ConnectionFailed, "unknown channel type")
+		}
+	}
+}
+
+// serveRemoteForward relays each connection accepted by l over a
+// "forwarded-tcpip" channel opened toward the client of conn.
+func serveRemoteForward(conn ssh.Conn, l net.Listener, bindAddr string, bindPort uint32) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			ch, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+				Addr       string
+				Port       uint32
+				OriginAddr string
+				OriginPort uint32
+			}{bindAddr, bindPort, origin.IP.String(), uint32(origin.Port)}))
+			if err != nil {
+				return
+			}
+			defer ch.Close()
+			go ssh.DiscardRequests(reqs)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_, _ = io.Copy(c, ch)
+			}()
+			_, _ = io.Copy(ch, c)
+			_ = ch.CloseWrite()
+			<-done
+		}()
+	}
+}
+
+// newProxiedClient runs proxy against an in-process client connection and
+// returns an *ssh.Client talking through it. The returned channel receives
+// the result of proxy.Serve.
+func newProxiedClient(t *testing.T, ctx context.Context, proxy *ReverseProxy) (*ssh.Client, <-chan error) {
+	t.Helper()
+	return newServedClient(t, func(serverConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) error {
+		return proxy.Serve(ctx, serverConn, chans, reqs)
+	})
+}
+
+// newServedClient is like newProxiedClient, but serves the server side of the
+// connection with an arbitrary function.
+func newServedClient(t *testing.T, serve func(*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request) error) (*ssh.Client, <-chan error) {
+	t.Helper()
+	left, right, err := tcpPipeWithDialer(net.Dial, net.Listen)
+	if err != nil {
+		t.Fatalf("new net pipe: %v", err)
+	}
+	t.Cleanup(func() {
+		left.Close()
+		right.Close()
+	})
+
+	signer, err := generateSigner()
+	if err != nil {
+		t.Fatalf("generate signer: %v", err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serverConn, serverChans, serverReqs, err := ssh.NewServerConn(right, serverConfig)
+		if err != nil {
+			serveErr <- err
+			return
+		}
+		serveErr <- serve(serverConn, serverChans, serverReqs)
+	}()
+
+	clientConn, clientChans, clientReqs, err := ssh.NewClientConn(left, "localhost", &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("new client conn: %v", err)
+	}
+	client := ssh.NewClient(clientConn, clientChans, clientReqs)
+	t.Cleanup(func() { client.Close() })
+	return client, serveErr
+}
+
+// testClientConfig returns a client config suitable for dialing a test backend.
+func testClientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         3 * time.Second,
+	}
+}
@@ -0,0 +1,140 @@
+// Package sshproxytest provides utilities for testing code built on sshproxy
+// without an external SSH server.
+package sshproxytest // import "github.com/cmoog/sshproxy/sshproxytest"
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cmoog/sshproxy"
+)
+
+// Handler serves a single SSH connection accepted by a test backend.
+type Handler func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request)
+
+// NewTestProxy returns a client connected through a new sshproxy.ReverseProxy
+// to an in-process backend served by handler. See NewClient.
+func NewTestProxy(t testing.TB, handler Handler) *ssh.Client {
+	t.Helper()
+	return NewClient(t, sshproxy.New("backend", ClientConfig()), handler)
+}
+
+// NewClient returns a client connected through proxy to an in-process
+// backend served by handler. The proxy's Dial is replaced such that every
+// target connection reaches the backend over loopback TCP, as the SSH version
+// exchange deadlocks over the synchronous net.Pipe. The client, proxy, and
+// backend are shut down when the test completes, at which point any error
+// returned by the proxy other than the connection closing fails the test.
+func NewClient(t testing.TB, proxy *sshproxy.ReverseProxy, handler Handler) *ssh.Client {
+	t.Helper()
+	backendAddr := newBackend(t, handler)
+	proxy.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", backendAddr)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("sshproxytest: listen: %v", err)
+	}
+	defer listener.Close()
+
+	config := serverConfig(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serveErr <- err
+			return
+		}
+		defer conn.Close()
+		serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			serveErr <- err
+			return
+		}
+		serveErr <- proxy.Serve(ctx, serverConn, chans, reqs)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), ClientConfig())
+	if err != nil {
+		cancel()
+		t.Fatalf("sshproxytest: dial proxy: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		err := <-serveErr
+		cancel()
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			t.Errorf("sshproxytest: reverse proxy: %v", err)
+		}
+	})
+	return client
+}
+
+// ClientConfig returns the client config used to connect to the proxy and
+// by NewTestProxy to connect to the backend. Host keys are not verified.
+func ClientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         3 * time.Second,
+	}
+}
+
+// newBackend starts an in-process SSH server, returning its address. Each
+// accepted connection is served by handler.
+func newBackend(t testing.TB, handler Handler) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("sshproxytest: listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	config := serverConfig(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				defer serverConn.Close()
+				handler(serverConn, chans, reqs)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serverConfig returns a server config without client
+// authentication and with a generated host key.
+func serverConfig(t testing.TB) *ssh.ServerConfig {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("sshproxytest: generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("sshproxytest: new signer: %v", err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	return config
+}
@@ -0,0 +1,82 @@
+package sshproxytest
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cmoog/sshproxy"
+)
+
+// serveExec accepts "session" channels and replies to "exec" requests by
+// writing the command back, followed by a zero exit status.
+func serveExec(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			_ = newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				if req.Type != "exec" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				var cmd struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &cmd); err != nil {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, nil)
+				_, _ = ch.Write([]byte(cmd.Command))
+				_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+func Test_newTestProxy(t *testing.T) {
+	client := NewTestProxy(t, serveExec)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	out, err := session.Output("hello")
+	if err != nil {
+		t.Fatalf("run command: %v", err)
+	}
+	if string(out) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", out)
+	}
+}
+
+func Test_newClient(t *testing.T) {
+	var resolved bool
+	proxy := &sshproxy.ReverseProxy{
+		TargetResolver: func(ctx context.Context, serverConn *ssh.ServerConn) (string, *ssh.ClientConfig, error) {
+			resolved = true
+			return "backend", ClientConfig(), nil
+		},
+	}
+	client := NewClient(t, proxy, serveExec)
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	if err := session.Run("true"); err != nil {
+		t.Fatalf("run command: %v", err)
+	}
+	if !resolved {
+		t.Fatalf("expected the given proxy to serve the connection")
+	}
+}
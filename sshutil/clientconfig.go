@@ -0,0 +1,113 @@
+package sshutil
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultIdentities are the private key files tried by OpenSSH when no
+// IdentityFile is configured, in order of preference.
+var defaultIdentities = []string{"id_rsa", "id_ecdsa", "id_ed25519", "id_dsa"}
+
+// LoadClientConfig returns a client config for user that authenticates with
+// the private keys in dir and verifies host keys against dir/known_hosts,
+// following the layout of an OpenSSH ~/.ssh directory. Encrypted private keys
+// produce an error; use LoadClientConfigWithPassphrase to decrypt them.
+func LoadClientConfig(dir, user string) (*ssh.ClientConfig, error) {
+	return LoadClientConfigWithPassphrase(dir, user, nil)
+}
+
+// LoadClientConfigWithPassphrase is like LoadClientConfig, but calls
+// passphrase with the path of each encrypted private key to decrypt it.
+//
+// Private keys are read from the files in dir named "id_*", other than
+// public keys ending in ".pub", trying OpenSSH's default identities first.
+// At least one private key must be present. If dir has no known_hosts file,
+// every host is treated as unknown, producing a *HostKeyError matching
+// ErrUnknownHost, like OpenSSH in batch mode.
+func LoadClientConfigWithPassphrase(dir, user string, passphrase func(path string) ([]byte, error)) (*ssh.ClientConfig, error) {
+	paths, err := identityPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	var signers []ssh.Signer
+	for _, path := range paths {
+		signer, err := loadSigner(path, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("sshutil: no private keys in %s", dir)
+	}
+
+	hostKeyCallback, err := KnownHostsCallback(filepath.Join(dir, "known_hosts"))
+	if errors.Is(err, os.ErrNotExist) {
+		hostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return &HostKeyError{Hostname: hostname, Remote: remote, Key: key, err: &knownhosts.KeyError{}}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// identityPaths returns the private key files in dir, with
+// OpenSSH's default identities first and the rest sorted by name.
+func identityPaths(dir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "id_*"))
+	if err != nil {
+		return nil, fmt.Errorf("sshutil: find private keys: %w", err)
+	}
+	rank := func(path string) int {
+		for i, name := range defaultIdentities {
+			if filepath.Base(path) == name {
+				return i
+			}
+		}
+		return len(defaultIdentities)
+	}
+	var paths []string
+	for _, path := range matches {
+		if !strings.HasSuffix(path, ".pub") {
+			paths = append(paths, path)
+		}
+	}
+	sort.SliceStable(paths, func(i, j int) bool { return rank(paths[i]) < rank(paths[j]) })
+	return paths, nil
+}
+
+// loadSigner parses the private key at path, decrypting it with the
+// passphrase callback if it is encrypted.
+func loadSigner(path string, passphrase func(path string) ([]byte, error)) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("sshutil: read private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	var missingErr *ssh.PassphraseMissingError
+	if errors.As(err, &missingErr) && passphrase != nil {
+		var pass []byte
+		if pass, err = passphrase(path); err != nil {
+			return nil, fmt.Errorf("sshutil: passphrase for %s: %w", path, err)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, pass)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sshutil: parse private key %s: %w", path, err)
+	}
+	return signer, nil
+}
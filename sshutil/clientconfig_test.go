@@ -0,0 +1,168 @@
+package sshutil
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The fixtures in testdata/client hold an unencrypted ed25519 key and the
+// known_hosts entry for seedSigner(1) at [127.0.0.1]:2222, while the ECDSA
+// key in testdata/client_encrypted is encrypted with encryptedPassphrase.
+const (
+	clientFixture          = "testdata/client"
+	encryptedClientFixture = "testdata/client_encrypted"
+	encryptedPassphrase    = "hunter2"
+)
+
+func Test_loadClientConfig(t *testing.T) {
+	config, err := LoadClientConfig(clientFixture, "alice")
+	if err != nil {
+		t.Fatalf("load client config: %v", err)
+	}
+	if config.User != "alice" {
+		t.Fatalf("expected user alice, got %q", config.User)
+	}
+	authorized := readPublicKey(t, filepath.Join(clientFixture, "id_ed25519.pub"))
+
+	// complete a handshake with a server using the known host key,
+	// which only accepts the fixture's public key
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, errors.New("unauthorized key")
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(seedSigner(t, 1))
+	if err := handshake(t, serverConfig, "127.0.0.1:2222", config); err != nil {
+		t.Fatalf("expected handshake to succeed, got: %v", err)
+	}
+
+	// a host with a different key is rejected
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+	if err := config.HostKeyCallback("127.0.0.1:2222", addr, seedSigner(t, 2).PublicKey()); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("expected %v, got: %v", ErrHostKeyMismatch, err)
+	}
+}
+
+func Test_loadClientConfigEncrypted(t *testing.T) {
+	var missingErr *ssh.PassphraseMissingError
+	if _, err := LoadClientConfig(encryptedClientFixture, "alice"); !errors.As(err, &missingErr) {
+		t.Fatalf("expected *ssh.PassphraseMissingError, got: %v", err)
+	}
+
+	if _, err := LoadClientConfigWithPassphrase(encryptedClientFixture, "alice", func(string) ([]byte, error) {
+		return []byte("incorrect"), nil
+	}); !errors.Is(err, x509.IncorrectPasswordError) {
+		t.Fatalf("expected incorrect passphrase error, got: %v", err)
+	}
+
+	var requested string
+	config, err := LoadClientConfigWithPassphrase(encryptedClientFixture, "alice", func(path string) ([]byte, error) {
+		requested = path
+		return []byte(encryptedPassphrase), nil
+	})
+	if err != nil {
+		t.Fatalf("load client config: %v", err)
+	}
+	if requested != filepath.Join(encryptedClientFixture, "id_ecdsa") {
+		t.Fatalf("expected passphrase requested for id_ecdsa, got %q", requested)
+	}
+
+	// without known_hosts, every host is unknown
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+	if err := config.HostKeyCallback("127.0.0.1:2222", addr, seedSigner(t, 1).PublicKey()); !errors.Is(err, ErrUnknownHost) {
+		t.Fatalf("expected %v, got: %v", ErrUnknownHost, err)
+	}
+}
+
+func Test_loadClientConfigNoKeys(t *testing.T) {
+	if _, err := LoadClientConfig(t.TempDir(), "alice"); err == nil {
+		t.Fatalf("expected error for a directory without private keys")
+	}
+}
+
+func Test_identityPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"id_a", "id_ed25519", "id_ed25519.pub", "id_rsa", "known_hosts"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	paths, err := identityPaths(dir)
+	if err != nil {
+		t.Fatalf("identity paths: %v", err)
+	}
+	var names []string
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	expected := []string{"id_rsa", "id_ed25519", "id_a"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected, names)
+		}
+	}
+}
+
+func readPublicKey(t *testing.T, path string) ssh.PublicKey {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read public key: %v", err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		t.Fatalf("parse public key: %v", err)
+	}
+	return key
+}
+
+// handshake connects a client with config to a server with serverConfig over
+// loopback TCP, verifying the server's host key as addr.
+func handshake(t *testing.T, serverConfig *ssh.ServerConfig, addr string, config *ssh.ClientConfig) error {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serverConn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			_ = newCh.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	clientConn, _, _, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		return err
+	}
+	return clientConn.Close()
+}
@@ -0,0 +1,3 @@
+// Package sshutil provides helpers for configuring the
+// `golang.org/x/crypto/ssh` clients and servers used with sshproxy.
+package sshutil // import "github.com/cmoog/sshproxy/sshutil"
@@ -0,0 +1,79 @@
+package sshutil
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	// ErrUnknownHost matches a *HostKeyError for a host
+	// that has no entry in the known_hosts file.
+	ErrUnknownHost = errors.New("sshutil: unknown host")
+
+	// ErrHostKeyMismatch matches a *HostKeyError for a host whose entries
+	// in the known_hosts file do not include the presented key.
+	ErrHostKeyMismatch = errors.New("sshutil: host key mismatch")
+)
+
+// HostKeyError is returned by the callback from KnownHostsCallback when the
+// presented host key is not trusted. Use errors.Is with ErrUnknownHost or
+// ErrHostKeyMismatch to distinguish the two cases, for example to implement
+// trust on first use for unknown hosts only.
+type HostKeyError struct {
+	Hostname string
+	Remote   net.Addr
+	Key      ssh.PublicKey
+
+	// Want lists the keys known for the host. It is empty if the host is unknown.
+	Want []knownhosts.KnownKey
+
+	err *knownhosts.KeyError
+}
+
+func (e *HostKeyError) Error() string {
+	if len(e.Want) == 0 {
+		return fmt.Sprintf("sshutil: unknown host %s: %v", e.Hostname, e.err)
+	}
+	return fmt.Sprintf("sshutil: host key mismatch for %s: %v", e.Hostname, e.err)
+}
+
+func (e *HostKeyError) Unwrap() error { return e.err }
+
+func (e *HostKeyError) Is(target error) bool {
+	switch target {
+	case ErrUnknownHost:
+		return len(e.Want) == 0
+	case ErrHostKeyMismatch:
+		return len(e.Want) != 0
+	}
+	return false
+}
+
+// KnownHostsCallback loads an OpenSSH known_hosts file and returns a callback
+// for use as ssh.ClientConfig.HostKeyCallback. Hashed host entries and
+// "@cert-authority" lines are supported. Keys that are not trusted produce
+// a *HostKeyError, while revoked keys produce a *knownhosts.RevokedError.
+func KnownHostsCallback(path string) (ssh.HostKeyCallback, error) {
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("load known hosts: %w", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			return &HostKeyError{
+				Hostname: hostname,
+				Remote:   remote,
+				Key:      key,
+				Want:     keyErr.Want,
+				err:      keyErr,
+			}
+		}
+		return err
+	}, nil
+}
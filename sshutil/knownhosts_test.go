@@ -0,0 +1,105 @@
+package sshutil
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The keys in testdata/known_hosts are derived from seedSigner(1),
+// seedSigner(2), and, for the certificate authority, seedSigner(3).
+const knownHostsFixture = "testdata/known_hosts"
+
+func seedSigner(t *testing.T, seed byte) ssh.Signer {
+	t.Helper()
+	priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("new signer: %v", err)
+	}
+	return signer
+}
+
+func Test_knownHostsCallback(t *testing.T) {
+	callback, err := KnownHostsCallback(knownHostsFixture)
+	if err != nil {
+		t.Fatalf("load known hosts: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+
+	tests := []struct {
+		name     string
+		hostname string
+		key      ssh.PublicKey
+		expected error
+	}{
+		{"plain", "127.0.0.1:2222", seedSigner(t, 1).PublicKey(), nil},
+		{"hashed", "hashed.example.com:22", seedSigner(t, 2).PublicKey(), nil},
+		{"mismatch", "127.0.0.1:2222", seedSigner(t, 2).PublicKey(), ErrHostKeyMismatch},
+		{"hashed_mismatch", "hashed.example.com:22", seedSigner(t, 1).PublicKey(), ErrHostKeyMismatch},
+		{"unknown", "unknown.example.com:22", seedSigner(t, 1).PublicKey(), ErrUnknownHost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := callback(tt.hostname, addr, tt.key)
+			if tt.expected == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, got: %v", tt.expected, err)
+			}
+			var hostKeyErr *HostKeyError
+			if !errors.As(err, &hostKeyErr) || hostKeyErr.Hostname != tt.hostname {
+				t.Fatalf("expected *HostKeyError for %s, got: %v", tt.hostname, err)
+			}
+		})
+	}
+}
+
+func Test_knownHostsCertAuthority(t *testing.T) {
+	callback, err := KnownHostsCallback(knownHostsFixture)
+	if err != nil {
+		t.Fatalf("load known hosts: %v", err)
+	}
+
+	hostPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	hostKey, err := ssh.NewPublicKey(hostPub)
+	if err != nil {
+		t.Fatalf("new public key: %v", err)
+	}
+	cert := &ssh.Certificate{
+		Key:             hostKey,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"db.internal"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, seedSigner(t, 3)); err != nil {
+		t.Fatalf("sign host certificate: %v", err)
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+	if err := callback("db.internal:22", addr, cert); err != nil {
+		t.Fatalf("expected certificate signed by known authority to be accepted: %v", err)
+	}
+	if err := callback("db.external:22", addr, cert); err == nil {
+		t.Fatalf("expected certificate for host outside the authority's pattern to be rejected")
+	}
+}
+
+func Test_knownHostsMissingFile(t *testing.T) {
+	_, err := KnownHostsCallback("testdata/does-not-exist")
+	if err == nil {
+		t.Fatalf("expected error loading missing known hosts file")
+	}
+}
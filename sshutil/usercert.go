@@ -0,0 +1,131 @@
+package sshutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrNotCertificate matches a *CertError for a key that
+	// is not an SSH user certificate.
+	ErrNotCertificate = errors.New("sshutil: not a user certificate")
+
+	// ErrUnknownAuthority matches a *CertError for a certificate
+	// that is not signed by a trusted certificate authority.
+	ErrUnknownAuthority = errors.New("sshutil: certificate signed by unknown authority")
+
+	// ErrPrincipalNotAllowed matches a *CertError for a certificate
+	// that is not valid for the user attempting to authenticate.
+	ErrPrincipalNotAllowed = errors.New("sshutil: principal not allowed by certificate")
+
+	// ErrCertNotYetValid matches a *CertError for a certificate
+	// whose validity window has not yet started.
+	ErrCertNotYetValid = errors.New("sshutil: certificate not yet valid")
+
+	// ErrCertExpired matches a *CertError for a certificate
+	// whose validity window has ended.
+	ErrCertExpired = errors.New("sshutil: certificate expired")
+
+	// ErrInvalidCertificate matches a *CertError for a certificate
+	// that fails any other check, such as its signature.
+	ErrInvalidCertificate = errors.New("sshutil: invalid certificate")
+)
+
+// CertError is returned by the callback from UserCertCallback when the
+// presented key is rejected. Use errors.Is with one of the ErrNotCertificate,
+// ErrUnknownAuthority, ErrPrincipalNotAllowed, ErrCertNotYetValid,
+// ErrCertExpired, or ErrInvalidCertificate errors to determine why.
+type CertError struct {
+	User string
+	Key  ssh.PublicKey
+
+	// Cert is the presented certificate, or nil if
+	// the key is not a certificate.
+	Cert *ssh.Certificate
+
+	reason error
+	err    error
+}
+
+func (e *CertError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%v for %s: %v", e.reason, e.User, e.err)
+	}
+	return fmt.Sprintf("%v for %s", e.reason, e.User)
+}
+
+func (e *CertError) Unwrap() error { return e.err }
+
+func (e *CertError) Is(target error) bool { return target == e.reason }
+
+// UserCertCallback returns a callback for use as
+// ssh.ServerConfig.PublicKeyCallback that only accepts SSH user certificates
+// signed by one of the given certificate authorities, whose valid principals
+// include the user name and whose validity window includes the current time.
+// Certificates with critical options other than "source-address" are
+// rejected. Rejected keys produce a *CertError. The permissions of an
+// accepted certificate are returned to the server.
+func UserCertCallback(authorities ...ssh.PublicKey) func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return isAuthority(authorities, auth)
+		},
+	}
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		certErr := &CertError{User: conn.User(), Key: key}
+		cert, ok := key.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.UserCert {
+			certErr.reason = ErrNotCertificate
+			return nil, certErr
+		}
+		certErr.Cert = cert
+
+		if !isAuthority(authorities, cert.SignatureKey) {
+			certErr.reason = ErrUnknownAuthority
+			return nil, certErr
+		}
+		if !hasPrincipal(cert, conn.User()) {
+			certErr.reason = ErrPrincipalNotAllowed
+			return nil, certErr
+		}
+		unix := time.Now().Unix()
+		if after := int64(cert.ValidAfter); after < 0 || unix < after {
+			certErr.reason = ErrCertNotYetValid
+			return nil, certErr
+		}
+		if before := int64(cert.ValidBefore); cert.ValidBefore != ssh.CertTimeInfinity && (before < 0 || unix >= before) {
+			certErr.reason = ErrCertExpired
+			return nil, certErr
+		}
+
+		// verify the signature and critical options
+		if err := checker.CheckCert(conn.User(), cert); err != nil {
+			certErr.reason = ErrInvalidCertificate
+			certErr.err = err
+			return nil, certErr
+		}
+		return &cert.Permissions, nil
+	}
+}
+
+func isAuthority(authorities []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, authority := range authorities {
+		if bytes.Equal(authority.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrincipal(cert *ssh.Certificate, user string) bool {
+	for _, principal := range cert.ValidPrincipals {
+		if principal == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package sshutil
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// userConnMetadata is an ssh.ConnMetadata for the given user.
+type userConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (m userConnMetadata) User() string { return m.user }
+
+func Test_userCertCallback(t *testing.T) {
+	now := time.Now()
+	authority, otherAuthority := seedSigner(t, 3), seedSigner(t, 4)
+	userKey := seedSigner(t, 1).PublicKey()
+
+	newCert := func(t *testing.T, signer ssh.Signer, modify func(*ssh.Certificate)) *ssh.Certificate {
+		t.Helper()
+		cert := &ssh.Certificate{
+			Key:             userKey,
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"alice"},
+			ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(now.Add(time.Minute).Unix()),
+		}
+		if modify != nil {
+			modify(cert)
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatalf("sign user certificate: %v", err)
+		}
+		return cert
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		key      ssh.PublicKey
+		expected error
+	}{
+		{"valid", "alice", newCert(t, authority, nil), nil},
+		{"no_expiry", "alice", newCert(t, authority, func(c *ssh.Certificate) { c.ValidBefore = ssh.CertTimeInfinity }), nil},
+		{"plain_key", "alice", userKey, ErrNotCertificate},
+		{"host_cert", "alice", newCert(t, authority, func(c *ssh.Certificate) { c.CertType = ssh.HostCert }), ErrNotCertificate},
+		{"wrong_authority", "alice", newCert(t, otherAuthority, nil), ErrUnknownAuthority},
+		{"wrong_principal", "bob", newCert(t, authority, nil), ErrPrincipalNotAllowed},
+		{"not_yet_valid", "alice", newCert(t, authority, func(c *ssh.Certificate) { c.ValidAfter = uint64(now.Add(time.Minute).Unix()) }), ErrCertNotYetValid},
+		{"expired", "alice", newCert(t, authority, func(c *ssh.Certificate) { c.ValidBefore = uint64(now.Add(-time.Second).Unix()) }), ErrCertExpired},
+		{"critical_option", "alice", newCert(t, authority, func(c *ssh.Certificate) {
+			c.CriticalOptions = map[string]string{"force-command": "true"}
+		}), ErrInvalidCertificate},
+	}
+	callback := UserCertCallback(authority.PublicKey())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms, err := callback(userConnMetadata{user: tt.user}, tt.key)
+			if tt.expected == nil {
+				if err != nil || perms == nil {
+					t.Fatalf("expected certificate to be accepted, got: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, got: %v", tt.expected, err)
+			}
+			var certErr *CertError
+			if !errors.As(err, &certErr) || certErr.User != tt.user {
+				t.Fatalf("expected *CertError for %s, got: %v", tt.user, err)
+			}
+		})
+	}
+}
+
+func Test_userCertCallbackTamperedSignature(t *testing.T) {
+	authority := seedSigner(t, 3)
+	cert := &ssh.Certificate{
+		Key:             seedSigner(t, 1).PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"alice"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatalf("sign user certificate: %v", err)
+	}
+	// extend the principals after signing
+	cert.ValidPrincipals = append(cert.ValidPrincipals, "root")
+
+	callback := UserCertCallback(authority.PublicKey())
+	if _, err := callback(userConnMetadata{user: "root"}, cert); !errors.Is(err, ErrInvalidCertificate) {
+		t.Fatalf("expected %v, got: %v", ErrInvalidCertificate, err)
+	}
+}
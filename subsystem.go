@@ -0,0 +1,33 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const subsystemRequestType = "subsystem"
+
+// subsystemRequest is the payload of a "subsystem" channel request,
+// as described in RFC 4254, section 6.5.
+type subsystemRequest struct {
+	Name string
+}
+
+// ParseSubsystemRequest decodes the payload of a "subsystem" request,
+// returning the name of the subsystem, such as "sftp".
+func ParseSubsystemRequest(payload []byte) (string, error) {
+	var req subsystemRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return "", fmt.Errorf("parse subsystem payload: %w", err)
+	}
+	return req.Name, nil
+}
+
+// allowSubsystem reports whether the "subsystem" request with the given
+// payload is allowed by SubsystemFilter. Malformed payloads are rejected.
+func (c *proxyConn) allowSubsystem(ctx context.Context, payload []byte) bool {
+	name, err := ParseSubsystemRequest(payload)
+	return err == nil && c.proxy.SubsystemFilter(ctx, name)
+}
@@ -0,0 +1,68 @@
+package sshproxy
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_parseSubsystemRequest(t *testing.T) {
+	name, err := ParseSubsystemRequest(ssh.Marshal(subsystemRequest{Name: "sftp"}))
+	if err != nil || name != "sftp" {
+		t.Fatalf("expected sftp, got %q: %v", name, err)
+	}
+	if _, err := ParseSubsystemRequest([]byte("invalid")); err == nil {
+		t.Fatalf("expected error parsing invalid payload")
+	}
+}
+
+func Test_subsystemFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendAddr := newTestBackend(t, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			defer ch.Close()
+			go func() {
+				for req := range reqs {
+					_ = req.Reply(true, nil)
+				}
+			}()
+		}
+	})
+	proxy := New(backendAddr, testClientConfig())
+	proxy.SubsystemFilter = func(_ context.Context, name string) bool {
+		return name != "sftp"
+	}
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	for subsystem, allowed := range map[string]bool{"sftp": false, "netconf": true} {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("new ssh session: %v", err)
+		}
+		err = session.RequestSubsystem(subsystem)
+		if allowed && err != nil {
+			t.Fatalf("expected %s subsystem to be allowed: %v", subsystem, err)
+		}
+		if !allowed && err == nil {
+			t.Fatalf("expected %s subsystem to be blocked", subsystem)
+		}
+		session.Close()
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer session.Close()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("expected shell to be allowed: %v", err)
+	}
+}
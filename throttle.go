@@ -0,0 +1,81 @@
+package sshproxy
+
+import (
+	"io"
+	"sync"
+)
+
+// byteBudget limits the number of bytes in flight between the reads and
+// writes of the channel copies of a connection.
+type byteBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+}
+
+func newByteBudget(max int64) *byteBudget {
+	b := &byteBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes are available. A request exceeding the
+// limit is granted once no other bytes are in flight.
+func (b *byteBudget) acquire(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used > 0 && b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+func (b *byteBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.cond.Broadcast()
+}
+
+// throttledReader acquires the bytes of each read from the budget once the
+// read returns, such that a reader blocked on an idle stream holds none of
+// it. Until the bytes are acquired, the read does not return and no further
+// reads are made. The bytes remain acquired until they are written by the
+// matching throttledWriter.
+type throttledReader struct {
+	io.Reader
+	budget *byteBudget
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.budget.acquire(int64(n))
+	}
+	return n, err
+}
+
+// throttledWriter releases the bytes of each write to the budget
+// once the write has completed.
+type throttledWriter struct {
+	io.Writer
+	budget *byteBudget
+}
+
+func (w throttledWriter) Write(p []byte) (int, error) {
+	defer w.budget.release(int64(len(p)))
+	return w.Writer.Write(p)
+}
+
+// throttle wraps the reader and writer of a copy with the connection's
+// budget, if MaxInFlightBytes is set.
+func (c *proxyConn) throttle(w io.Writer, r io.Reader) (io.Writer, io.Reader) {
+	if c.budget == nil {
+		return w, r
+	}
+	return throttledWriter{w, c.budget}, throttledReader{r, c.budget}
+}
@@ -0,0 +1,126 @@
+package sshproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// inFlightCounter tracks the peak number of bytes
+// being written concurrently by countedWriters.
+type inFlightCounter struct {
+	inFlight, peak int64
+}
+
+func (c *inFlightCounter) add(n int64) {
+	inFlight := atomic.AddInt64(&c.inFlight, n)
+	for {
+		peak := atomic.LoadInt64(&c.peak)
+		if inFlight <= peak || atomic.CompareAndSwapInt64(&c.peak, peak, inFlight) {
+			return
+		}
+	}
+}
+
+// countedWriter simulates a slow destination, such that
+// the writes of concurrent copies overlap.
+type countedWriter struct {
+	io.Writer
+	counter *inFlightCounter
+}
+
+func (w countedWriter) Write(p []byte) (int, error) {
+	w.counter.add(int64(len(p)))
+	defer w.counter.add(-int64(len(p)))
+	time.Sleep(100 * time.Microsecond)
+	return w.Writer.Write(p)
+}
+
+// copyConcurrently copies size bytes through each of copies concurrent
+// copyChannels on one connection, returning the peak bytes being written.
+func copyConcurrently(c *proxyConn, copies, size int) int64 {
+	data := bytes.Repeat([]byte("a"), size)
+	var counter inFlightCounter
+	var wg sync.WaitGroup
+	wg.Add(copies)
+	for i := 0; i < copies; i++ {
+		go func() {
+			defer wg.Done()
+			w := memChannel{Writer: countedWriter{io.Discard, &counter}, stderr: &bytes.Buffer{}}
+			r := memChannel{Reader: bytes.NewReader(data), stderr: &bytes.Buffer{}}
+			c.copyChannels(w, r, new(int64), new(int64))
+		}()
+	}
+	wg.Wait()
+	return atomic.LoadInt64(&counter.peak)
+}
+
+func Test_maxInFlightBytes(t *testing.T) {
+	const limit = 2 * defaultBufferSize
+	c := &proxyConn{proxy: &ReverseProxy{}, logger: printfLogger{}, budget: newByteBudget(limit)}
+	if peak := copyConcurrently(c, 8, 1024*1024); peak > limit {
+		t.Fatalf("expected at most %d bytes in flight, got %d", limit, peak)
+	}
+}
+
+func BenchmarkCopyChannelsInFlight(b *testing.B) {
+	for name, limit := range map[string]int64{
+		"unlimited": 0,
+		"limited":   2 * defaultBufferSize,
+	} {
+		b.Run(name, func(b *testing.B) {
+			c := &proxyConn{proxy: &ReverseProxy{}, logger: printfLogger{}}
+			if limit > 0 {
+				c.budget = newByteBudget(limit)
+			}
+			var peak int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if n := copyConcurrently(c, 16, 256*1024); n > peak {
+					peak = n
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-bytes")
+		})
+	}
+}
+
+func Test_maxInFlightBytesIdleSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(newTestBackend(t, serveSessions), testClientConfig())
+	proxy.MaxInFlightBytes = 2 * defaultBufferSize
+	client, _ := newProxiedClient(t, ctx, proxy)
+
+	// an idle session blocks on reads from each of its streams
+	idle, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new ssh session: %v", err)
+	}
+	defer idle.Close()
+	stdin, err := idle.StdinPipe()
+	if err != nil {
+		t.Fatalf("stdin pipe: %v", err)
+	}
+	defer stdin.Close()
+	if err := idle.Start("cat"); err != nil {
+		t.Fatalf("start idle session: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		testStdin(t, client)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected active session to make progress next to an idle session")
+	}
+}